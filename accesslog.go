@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// CommonLogFormat is an AccessLogFormat resembling the Common Log Format
+	CommonLogFormat = `{{.ClientIP}} - {{.Username}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Command}} {{.Dest}}" {{.Reply}} {{.BytesReceived}}`
+
+	// CombinedLogFormat is an AccessLogFormat resembling the Combined Log
+	// Format, adding the bytes sent by the client and the duration
+	CombinedLogFormat = CommonLogFormat + ` {{.BytesSent}} {{.Duration}}`
+)
+
+// AccessLogEntry is the data available to an AccessLogFormat template
+type AccessLogEntry struct {
+	ClientIP string
+	// Username is "-" for unauthenticated connections
+	Username string
+	// Time the connection was accepted
+	Time time.Time
+	// Command is CONNECT, BIND, ASSOCIATE or the numeric command
+	Command string
+	// Dest is the requested destination, the FQDN rather than what it
+	// resolved to if one was requested
+	Dest string
+	// Reply is the reply code sent to the client, "-" if none was sent
+	Reply         string
+	BytesSent     int64
+	BytesReceived int64
+	Duration      time.Duration
+}
+
+// commandName returns the name of a SOCKS command
+func commandName(command uint8) string {
+	switch command {
+	case ConnectCommand:
+		return "CONNECT"
+	case BindCommand:
+		return "BIND"
+	case AssociateCommand:
+		return "ASSOCIATE"
+	}
+	return strconv.Itoa(int(command))
+}
+
+// requestedAddress returns the address as requested by the client,
+// which for FQDNs is not the resolved IP
+func requestedAddress(a *AddrSpec) string {
+	if a.FQDN != "" && a.UnixSocket == "" {
+		return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+	}
+	return a.Address()
+}
+
+// logAccess writes an access log line for a handled request
+func (s *Server) logAccess(req *Request, start time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+	entry := AccessLogEntry{
+		ClientIP:      "-",
+		Username:      "-",
+		Time:          start,
+		Command:       commandName(req.Command),
+		Dest:          requestedAddress(req.DestAddr),
+		Reply:         "-",
+		BytesSent:     req.bytesSent,
+		BytesReceived: req.bytesReceived,
+		Duration:      time.Since(start),
+	}
+	if req.RemoteAddr != nil {
+		entry.ClientIP = req.RemoteAddr.IP.String()
+	}
+	if user := req.AuthContext.username(); user != "" {
+		entry.Username = s.logUsername(user)
+	}
+	if req.replied {
+		entry.Reply = strconv.Itoa(int(req.replyCode))
+	}
+
+	var buf bytes.Buffer
+	if err := s.accessLog.Execute(&buf, &entry); err != nil {
+		s.config.Logger.Printf("[ERR] socks: Failed to format access log: %v", err)
+		return
+	}
+	s.config.Logger.Print(buf.String())
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chanWriter sends every write on the channel, which for a log.Logger
+// is a line each, so tests can wait for a line to be logged
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	echo := echoListener(t)
+	logs := make(chanWriter, 10)
+	proxy := startServer(t, &Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		AccessLogFormat: CombinedLogFormat,
+		Logger:          log.New(logs, "", 0),
+	})
+
+	d := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	var line string
+	select {
+	case line = <-logs:
+	case <-time.After(time.Second):
+		t.Fatalf("nothing logged")
+	}
+	re := regexp.MustCompile(`^127\.0\.0\.1 - foo \[[^]]+\] "CONNECT ` + regexp.QuoteMeta(echo.String()) + `" 0 4 4 \S+\n$`)
+	if !re.MatchString(line) {
+		t.Fatalf("bad: %q", line)
+	}
+}
+
+func TestAccessLog_FQDN(t *testing.T) {
+	echo := echoListener(t)
+	logs := make(chanWriter, 10)
+	proxy := startServer(t, &Config{
+		Resolver:        staticResolver{echo.IP},
+		AccessLogFormat: CommonLogFormat,
+		Logger:          log.New(logs, "", 0),
+	})
+
+	d := &Dialer{ProxyAddr: proxy, RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.example", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	var line string
+	select {
+	case line = <-logs:
+	case <-time.After(time.Second):
+		t.Fatalf("nothing logged")
+	}
+	if dest := fmt.Sprintf(`"CONNECT echo.example:%d"`, echo.Port); !strings.Contains(line, dest) {
+		t.Fatalf("bad: %q", line)
+	}
+}
+
+func TestAccessLog_InvalidFormat(t *testing.T) {
+	if _, err := New(&Config{AccessLogFormat: "{{.Nope"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// ActiveConnInfo describes a connection which is currently served
+type ActiveConnInfo struct {
+	ConnID     string
+	Username   string
+	RemoteAddr *AddrSpec
+	DestAddr   *AddrSpec
+	StartedAt  time.Time
+	// BytesSent and BytesReceived are the bytes relayed so far to and
+	// from the destination, updated at least every relay buffer
+	// (32 KiB), with zero-copy relaying too.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// activeConn is a registry entry of an active connection
+type activeConn struct {
+	info       ActiveConnInfo
+	clientConn net.Conn
+	serverConn *MeteredConn
+}
+
+// trackConn registers a connection in the active connection registry
+func (s *Server) trackConn(req *Request, clientConn net.Conn) *activeConn {
+	ac := &activeConn{
+		info: ActiveConnInfo{
+			ConnID:     req.ConnID,
+			Username:   req.AuthContext.username(),
+			RemoteAddr: req.RemoteAddr,
+			DestAddr:   req.DestAddr,
+			StartedAt:  s.clock().Now(),
+		},
+		clientConn: clientConn,
+	}
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	if s.active == nil {
+		s.active = make(map[string]*activeConn)
+	}
+	s.active[req.ConnID] = ac
+	return ac
+}
+
+// setServerConn records the dialed connection of an active connection
+func (s *Server) setServerConn(ac *activeConn, serverConn *MeteredConn) {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	ac.serverConn = serverConn
+}
+
+// untrackConn removes a connection from the active connection registry
+func (s *Server) untrackConn(ac *activeConn) {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	delete(s.active, ac.info.ConnID)
+}
+
+// ActiveConnections returns a snapshot of the connections currently
+// being relayed, ordered by start time
+func (s *Server) ActiveConnections() []ActiveConnInfo {
+	s.activeLock.Lock()
+	conns := make([]ActiveConnInfo, 0, len(s.active))
+	for _, ac := range s.active {
+		info := ac.info
+		if ac.serverConn != nil {
+			info.BytesSent = ac.serverConn.BytesWritten()
+			info.BytesReceived = ac.serverConn.BytesRead()
+		}
+		conns = append(conns, info)
+	}
+	s.activeLock.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].StartedAt.Before(conns[j].StartedAt)
+	})
+	return conns
+}
+
+// CloseConnection closes the client and destination connections of the
+// active connection with the given ID, which ends its relay and runs the
+// normal cleanup. Returns false if no such connection is active.
+func (s *Server) CloseConnection(id string) bool {
+	s.activeLock.Lock()
+	ac, ok := s.active[id]
+	var serverConn net.Conn
+	if ok && ac.serverConn != nil {
+		serverConn = ac.serverConn
+	}
+	s.activeLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	ac.clientConn.Close()
+	if serverConn != nil {
+		serverConn.Close()
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveConnections(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServerWith(t, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+
+	if conns := proxy.ActiveConnections(); len(conns) != 0 {
+		t.Fatalf("bad: %v", conns)
+	}
+
+	d := &Dialer{ProxyAddr: proxy.addr, Username: "foo", Password: "bar"}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+
+	conns := proxy.ActiveConnections()
+	if len(conns) != 1 {
+		t.Fatalf("bad: %v", conns)
+	}
+	if conns[0].ConnID == "" || conns[0].Username != "foo" || conns[0].DestAddr.Port != echo.Port {
+		t.Fatalf("bad: %#v", conns[0])
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(proxy.ActiveConnections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection was not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServerWith(t, &Config{IdleTimeout: time.Minute})
+
+	if proxy.CloseConnection("unknown") {
+		t.Fatalf("expected no connection")
+	}
+
+	d := &Dialer{ProxyAddr: proxy.addr}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	conns := proxy.ActiveConnections()
+	if len(conns) != 1 {
+		t.Fatalf("bad: %v", conns)
+	}
+	if !proxy.CloseConnection(conns[0].ConnID) {
+		t.Fatalf("expected connection")
+	}
+
+	// The client sees the connection closed
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected closed connection")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(proxy.ActiveConnections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection was not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"net"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 const (
@@ -16,9 +18,15 @@ const (
 	authFailure     = uint8(1)
 )
 
+// protocolErrorTimeout bounds writing a reply to a client which
+// violated the protocol
+const protocolErrorTimeout = time.Second
+
 var (
 	UserAuthFailed  = fmt.Errorf("User authentication failed")
 	NoSupportedAuth = fmt.Errorf("No supported authentication mechanism")
+
+	errTooManyAuthRounds = fmt.Errorf("Too many auth rounds")
 )
 
 // A Request encapsulates authentication state provided
@@ -28,8 +36,20 @@ type AuthContext struct {
 	Method uint8
 	// Payload provided during negotiation.
 	// Keys depend on the used auth method.
-	// For UserPassauth contains Username
+	// For UserPassauth contains Username. Custom authenticators should
+	// prefix their own keys to avoid clashes, e.g. "myauth.Session".
 	Payload map[string]string
+	// Tag parsed from the username by Config.UsernameTagParser,
+	// e.g. a tenant, for use by custom Rules, Rewriter or Dial
+	Tag string
+}
+
+// username returns the authenticated username, if any
+func (a *AuthContext) username() string {
+	if a == nil {
+		return ""
+	}
+	return a.Payload["Username"]
 }
 
 type Authenticator interface {
@@ -37,16 +57,62 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// RemoteAuthenticator can be implemented by an Authenticator which needs
+// the remote address of the client, e.g. to pin credentials to a source
+// network. When implemented, it is used instead of Authenticate.
+type RemoteAuthenticator interface {
+	AuthenticateRemote(reader io.Reader, writer net.Conn, remote *AddrSpec) (*AuthContext, error)
+}
+
+// ContextAuthenticator can be implemented by an Authenticator which needs
+// to pass state, e.g. a session token, on to the RuleSet, Resolver or
+// Dial. The returned context is the parent of the context of the request
+// handling, so its values are visible there. Use unexported key types as
+// for any context value. When implemented, it is used instead of
+// Authenticate and AuthenticateRemote.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, reader io.Reader, writer net.Conn) (context.Context, *AuthContext, error)
+}
+
+// ConditionalAuthenticator can be implemented by an Authenticator which
+// is only offered to some clients. When OfferTo returns false the method
+// is skipped as if the server didn't support it, so the client may
+// still negotiate another one.
+type ConditionalAuthenticator interface {
+	OfferTo(remote *AddrSpec) bool
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
-type NoAuthAuthenticator struct{}
+type NoAuthAuthenticator struct {
+	// AllowedNetworks restricts the "No Authentication" mode to clients
+	// from these networks, e.g. internal ones, while other clients must
+	// negotiate another method like UserPassAuth. Optional, all clients
+	// are allowed if empty.
+	AllowedNetworks []*net.IPNet
+}
 
 func (a NoAuthAuthenticator) GetCode() uint8 {
 	return NoAuth
 }
 
+func (a NoAuthAuthenticator) OfferTo(remote *AddrSpec) bool {
+	if len(a.AllowedNetworks) == 0 {
+		return true
+	}
+	if remote == nil {
+		return false
+	}
+	for _, n := range a.AllowedNetworks {
+		if n.Contains(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
-	return &AuthContext{NoAuth, nil}, err
+	return &AuthContext{Method: NoAuth}, err
 }
 
 // UserPassAuthenticator is used to handle username/password based
@@ -60,6 +126,10 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 }
 
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (*AuthContext, error) {
+	return a.AuthenticateRemote(reader, writer, remoteAddrSpec(writer))
+}
+
+func (a UserPassAuthenticator) AuthenticateRemote(reader io.Reader, writer net.Conn, remote *AddrSpec) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
@@ -67,36 +137,48 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (
 
 	// Get the version and username length
 	header := []byte{0, 0}
-	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, userPassFailure(writer, fmt.Errorf("Failed to read auth header: %v", err))
 	}
 
 	// Ensure we are compatible
 	if header[0] != userAuthVersion {
-		return nil, fmt.Errorf("Unsupported auth version: %v", header[0])
+		return nil, userPassFailure(writer, fmt.Errorf("Unsupported auth version: %v", header[0]))
 	}
 
-	// Get the user name
+	// Get the user name, RFC 1929 requires 1 to 255 bytes
 	userLen := int(header[1])
+	if userLen == 0 {
+		return nil, userPassFailure(writer, fmt.Errorf("Empty username"))
+	}
 	user := make([]byte, userLen)
-	if _, err := io.ReadAtLeast(reader, user, userLen); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, user); err != nil {
+		return nil, userPassFailure(writer, fmt.Errorf("Failed to read username: %v", err))
 	}
 
 	// Get the password length
-	if _, err := reader.Read(header[:1]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return nil, userPassFailure(writer, fmt.Errorf("Failed to read password length: %v", err))
 	}
 
-	// Get the password
+	// Get the password, also 1 to 255 bytes
 	passLen := int(header[0])
+	if passLen == 0 {
+		return nil, userPassFailure(writer, fmt.Errorf("Empty password"))
+	}
 	pass := make([]byte, passLen)
-	if _, err := io.ReadAtLeast(reader, pass, passLen); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, pass); err != nil {
+		return nil, userPassFailure(writer, fmt.Errorf("Failed to read password: %v", err))
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	var valid bool
+	if store, ok := a.Credentials.(RemoteCredentialStore); ok && remote != nil {
+		valid = store.ValidFrom(string(user), string(pass), remote)
+	} else {
+		valid = a.Credentials.Valid(string(user), string(pass))
+	}
+	if valid {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -108,53 +190,138 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": string(user)}}, nil
+}
+
+// userPassFailure sends the failure status of a malformed username/password
+// subnegotiation, so the client is told before the connection is closed
+func userPassFailure(writer io.Writer, err error) error {
+	writer.Write([]byte{userAuthVersion, authFailure})
+	return err
 }
 
 // authenticate is used to handle connection authentication
 func (s *Server) authenticate(conn net.Conn, bufConn io.Reader) (*AuthContext, error) {
+	_, authContext, err := s.authenticateWith(context.Background(), conn, bufConn, s.authMethods)
+	return authContext, err
+}
+
+// authenticateWith authenticates the connection with one of authMethods,
+// the returned context may have been enriched by the Authenticator
+func (s *Server) authenticateWith(ctx context.Context, conn net.Conn, bufConn io.Reader, authMethods map[uint8]Authenticator) (context.Context, *AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get auth methods: %v", err)
+		// A client stopping short of the announced methods is likely still
+		// waiting for an answer, unlike one which closed the connection
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			s.setWriteDeadline(conn, time.Now().Add(protocolErrorTimeout))
+			noAcceptableAuth(conn)
+		}
+		return ctx, nil, fmt.Errorf("Failed to get auth methods: %v", err)
+	}
+
+	// Reject clients advertising too many methods
+	if max := s.config.MaxAuthMethods; max > 0 && len(methods) > max {
+		s.authFailed(conn, methods, fmt.Errorf("Too many auth methods: %v", len(methods)))
+		return ctx, nil, noAcceptableAuth(conn)
 	}
 
 	// Select a usable method
+	remote := remoteAddrSpec(conn)
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
+		cator, found := authMethods[method]
+		if ocator, ok := cator.(ConditionalAuthenticator); found && ok && !ocator.OfferTo(remote) {
+			continue
+		}
 		if found {
-			ctx, err := cator.Authenticate(bufConn, conn)
-			if err != nil {
-				host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
-				select {
-				case s.AuthFailedInfoChan <- AuthFailedInfo{
-					IP:        host,
-					Port:      port,
-					Timestamp: time.Now(),
-					Reason:    []byte{method},
-					Error:     err,
-				}:
-				default:
+			if max := s.config.MaxAuthRounds; max > 0 {
+				rounds := &authRounds{max: max}
+				conn = &authRoundConn{Conn: conn, rounds: rounds}
+				bufConn = &authRoundReader{Reader: bufConn, rounds: rounds}
+			}
+			var authContext *AuthContext
+			var err error
+			if ccator, ok := cator.(ContextAuthenticator); ok {
+				var ctx_ context.Context
+				ctx_, authContext, err = ccator.AuthenticateContext(ctx, bufConn, conn)
+				if ctx_ != nil {
+					ctx = ctx_
 				}
+			} else if rcator, ok := cator.(RemoteAuthenticator); ok {
+				authContext, err = rcator.AuthenticateRemote(bufConn, conn, remote)
+			} else {
+				authContext, err = cator.Authenticate(bufConn, conn)
+			}
+			if rconn, ok := conn.(*authRoundConn); ok && rconn.rounds.exceeded {
+				authContext, err = nil, fmt.Errorf("%v: more than %d", errTooManyAuthRounds, rconn.rounds.max)
+			}
+			if err != nil {
+				s.authFailed(conn, []byte{method}, err)
 			}
-			return ctx, err
+			return ctx, authContext, err
+		}
+	}
+
+	s.authFailed(conn, methods, fmt.Errorf("No auth method supported"))
+
+	// No usable method found
+	return ctx, nil, noAcceptableAuth(conn)
+}
+
+// authRounds counts the rounds of an auth method, a round starts with
+// the first write after a read
+type authRounds struct {
+	max      int
+	rounds   int
+	writing  bool
+	exceeded bool
+}
+
+// authRoundConn counts the rounds of the writes of an auth method,
+// closing the connection once there are more than max
+type authRoundConn struct {
+	net.Conn
+	rounds *authRounds
+}
+
+func (c *authRoundConn) Write(b []byte) (int, error) {
+	if r := c.rounds; !r.writing {
+		r.writing = true
+		r.rounds++
+		if r.rounds > r.max {
+			r.exceeded = true
+			c.Conn.Close()
+			return 0, errTooManyAuthRounds
 		}
 	}
+	return c.Conn.Write(b)
+}
+
+// authRoundReader ends the turn of the writes of an auth method
+type authRoundReader struct {
+	io.Reader
+	rounds *authRounds
+}
 
+func (r *authRoundReader) Read(b []byte) (int, error) {
+	r.rounds.writing = false
+	return r.Reader.Read(b)
+}
+
+// authFailed pushes a failed auth attempt to AuthFailedInfoChan
+func (s *Server) authFailed(conn net.Conn, reason []byte, err error) {
 	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	select {
 	case s.AuthFailedInfoChan <- AuthFailedInfo{
 		IP:        host,
 		Port:      port,
-		Timestamp: time.Now(),
-		Reason:    methods,
-		Error:     fmt.Errorf("No auth method supported"),
+		Timestamp: s.clock().Now(),
+		Reason:    reason,
+		Error:     err,
 	}:
 	default:
 	}
-
-	// No usable method found
-	return nil, noAcceptableAuth(conn)
 }
 
 // noAcceptableAuth is used to handle when we have no eligible
@@ -2,13 +2,19 @@ package socks5
 
 import (
 	"bytes"
+	"io"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestNoAuth(t *testing.T) {
 	req := bytes.NewBuffer(nil)
 	req.Write([]byte{1, NoAuth})
-	var resp bytes.Buffer
+	var resp MockConn
 
 	s, _ := New(&Config{})
 	ctx, err := s.authenticate(&resp, req)
@@ -20,7 +26,7 @@ func TestNoAuth(t *testing.T) {
 		t.Fatal("Invalid Context Method")
 	}
 
-	out := resp.Bytes()
+	out := resp.buf.Bytes()
 	if !bytes.Equal(out, []byte{socks5Version, NoAuth}) {
 		t.Fatalf("bad: %v", out)
 	}
@@ -30,7 +36,7 @@ func TestPasswordAuth_Valid(t *testing.T) {
 	req := bytes.NewBuffer(nil)
 	req.Write([]byte{2, NoAuth, UserPassAuth})
 	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
-	var resp bytes.Buffer
+	var resp MockConn
 
 	cred := StaticCredentials{
 		"foo": "bar",
@@ -58,7 +64,7 @@ func TestPasswordAuth_Valid(t *testing.T) {
 		t.Fatal("Invalid Username in auth context's payload")
 	}
 
-	out := resp.Bytes()
+	out := resp.buf.Bytes()
 	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authSuccess}) {
 		t.Fatalf("bad: %v", out)
 	}
@@ -68,7 +74,7 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 	req := bytes.NewBuffer(nil)
 	req.Write([]byte{2, NoAuth, UserPassAuth})
 	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
-	var resp bytes.Buffer
+	var resp MockConn
 
 	cred := StaticCredentials{
 		"foo": "bar",
@@ -85,16 +91,77 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 		t.Fatal("Invalid Context Method")
 	}
 
-	out := resp.Bytes()
+	out := resp.buf.Bytes()
 	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
 		t.Fatalf("bad: %v", out)
 	}
 }
 
+func TestPasswordAuth_InvalidOverTCP(t *testing.T) {
+	proxy := startServer(t, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'}
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The RFC 1929 failure status is received before the connection is
+	// closed, rather than a reset
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 0x01, 0x01}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestPasswordAuth_Malformed(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	cred := StaticCredentials{long: long, "foo": "bar"}
+	for _, tc := range []struct {
+		name    string
+		request []byte
+		valid   bool
+	}{
+		{"max length", append(append([]byte{1, 255}, long...), append([]byte{255}, long...)...), true},
+		{"empty username", []byte{1, 0, 3, 'b', 'a', 'r'}, false},
+		{"empty password", []byte{1, 3, 'f', 'o', 'o', 0}, false},
+		{"bad version", []byte{5, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'}, false},
+		{"truncated header", []byte{1}, false},
+		{"truncated username", []byte{1, 3, 'f', 'o'}, false},
+		{"missing password length", []byte{1, 3, 'f', 'o', 'o'}, false},
+		{"truncated password", []byte{1, 3, 'f', 'o', 'o', 3, 'b'}, false},
+	} {
+		req := bytes.NewBuffer([]byte{1, UserPassAuth})
+		req.Write(tc.request)
+		var resp MockConn
+		s, _ := New(&Config{AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: cred}}})
+
+		_, err := s.authenticate(&resp, req)
+		if valid := err == nil; valid != tc.valid {
+			t.Fatalf("%v: err: %v", tc.name, err)
+		}
+		status := authFailure
+		if tc.valid {
+			status = authSuccess
+		}
+		out := resp.buf.Bytes()
+		if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, userAuthVersion, status}) {
+			t.Fatalf("%v: bad: %v", tc.name, out)
+		}
+	}
+}
+
 func TestNoSupportedAuth(t *testing.T) {
 	req := bytes.NewBuffer(nil)
 	req.Write([]byte{1, NoAuth})
-	var resp bytes.Buffer
+	var resp MockConn
 
 	cred := StaticCredentials{
 		"foo": "bar",
@@ -112,8 +179,259 @@ func TestNoSupportedAuth(t *testing.T) {
 		t.Fatal("Invalid Context Method")
 	}
 
-	out := resp.Bytes()
+	out := resp.buf.Bytes()
 	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+type pinnedCredentials struct {
+	StaticCredentials
+	network *net.IPNet
+}
+
+func (p pinnedCredentials) ValidFrom(user, password string, remote *AddrSpec) bool {
+	return p.network.Contains(remote.IP) && p.Valid(user, password)
+}
+
+func TestPasswordAuth_RemotePinned(t *testing.T) {
+	for _, tc := range []struct {
+		cidr  string
+		valid bool
+	}{
+		{"127.0.0.0/8", true},
+		{"10.0.0.0/8", false},
+	} {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{1, UserPassAuth})
+		req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		var resp MockConn
+
+		_, network, _ := net.ParseCIDR(tc.cidr)
+		cred := pinnedCredentials{StaticCredentials{"foo": "bar"}, network}
+		cator := UserPassAuthenticator{Credentials: cred}
+		s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+		_, err := s.authenticate(&resp, req)
+		if tc.valid && err != nil {
+			t.Fatalf("%v: err: %v", tc.cidr, err)
+		}
+		if !tc.valid && err != UserAuthFailed {
+			t.Fatalf("%v: err: %v", tc.cidr, err)
+		}
+	}
+}
+
+func TestNoAuth_AllowedNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		cidr   string
+		method uint8
+	}{
+		{"127.0.0.0/8", NoAuth},
+		{"10.0.0.0/8", noAcceptable},
+	} {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{1, NoAuth})
+		var resp MockConn
+
+		_, network, _ := net.ParseCIDR(tc.cidr)
+		s, _ := New(&Config{AuthMethods: []Authenticator{
+			NoAuthAuthenticator{AllowedNetworks: []*net.IPNet{network}},
+			UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}},
+		}})
+
+		_, err := s.authenticate(&resp, req)
+		if tc.method == NoAuth && err != nil {
+			t.Fatalf("%v: err: %v", tc.cidr, err)
+		}
+		if tc.method == noAcceptable && err != NoSupportedAuth {
+			t.Fatalf("%v: err: %v", tc.cidr, err)
+		}
+		if out := resp.buf.Bytes(); !bytes.Equal(out, []byte{socks5Version, tc.method}) {
+			t.Fatalf("%v: bad: %v", tc.cidr, out)
+		}
+	}
+}
+
+func TestMaxAuthMethods(t *testing.T) {
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{3, 1, 2, NoAuth})
+	var resp MockConn
+
+	s, _ := New(&Config{MaxAuthMethods: 2})
+
+	ctx, err := s.authenticate(&resp, req)
+	if err != NoSupportedAuth {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx != nil {
+		t.Fatal("Invalid Context Method")
+	}
+
+	out := resp.buf.Bytes()
+	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestAuth_TruncatedMethods(t *testing.T) {
+	s, _ := New(&Config{})
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Three methods announced but only one sent
+	go client.Write([]byte{5, 3, NoAuth})
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	go s.ServeConn(server)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+type sessionKey struct{}
+
+// sessionAuthenticator passes a session on in the context
+type sessionAuthenticator struct {
+	NoAuthAuthenticator
+}
+
+func (a sessionAuthenticator) AuthenticateContext(ctx context.Context, reader io.Reader, writer net.Conn) (context.Context, *AuthContext, error) {
+	authContext, err := a.Authenticate(reader, writer)
+	return context.WithValue(ctx, sessionKey{}, "session"), authContext, err
+}
+
+// requireSession only allows requests with a session
+type requireSession struct{}
+
+func (requireSession) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, ctx.Value(sessionKey{}) == "session"
+}
+
+func TestAuth_ContextAuthenticator(t *testing.T) {
+	dest := closingListener(t)
+	conf := &Config{Rules: requireSession{}}
+	serv, _ := New(conf)
+	if reply := connectThrough(t, serv, &AddrSpec{IP: dest.IP, Port: dest.Port}); reply != ruleFailure {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	conf = &Config{
+		AuthMethods: []Authenticator{sessionAuthenticator{}},
+		Rules:       requireSession{},
+	}
+	serv, _ = New(conf)
+	if reply := connectThrough(t, serv, &AddrSpec{IP: dest.IP, Port: dest.Port}); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+// loopAuthenticator challenges the client forever, like a multi-step
+// method which never completes
+type loopAuthenticator struct{}
+
+func (loopAuthenticator) GetCode() uint8 {
+	return 1
+}
+
+func (loopAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (*AuthContext, error) {
+	if _, err := writer.Write([]byte{socks5Version, 1}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1)
+	for {
+		if _, err := writer.Write([]byte{1, 0}); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestAuth_MaxAuthRounds(t *testing.T) {
+	s, err := New(&Config{AuthMethods: []Authenticator{loopAuthenticator{}}, MaxAuthRounds: 4})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write([]byte{5, 1, 1})
+		io.ReadFull(client, make([]byte, 2))
+		for {
+			if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+				return
+			}
+			client.Write([]byte{0})
+		}
+	}()
+
+	err = s.ServeConn(server)
+	if err == nil || !strings.Contains(err.Error(), "Too many auth rounds") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// splitWriteAuthenticator takes 2 rounds, writing each message byte by
+// byte, and records the writer it was given
+type splitWriteAuthenticator struct {
+	writer *io.Writer
+}
+
+func (splitWriteAuthenticator) GetCode() uint8 {
+	return 1
+}
+
+func (a splitWriteAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (*AuthContext, error) {
+	*a.writer = writer
+	buf := make([]byte, 1)
+	for _, msg := range [][]byte{{socks5Version, 1}, {1, 0, 0, 0}} {
+		for i := range msg {
+			if _, err := writer.Write(msg[i : i+1]); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+	}
+	return &AuthContext{Method: 1}, nil
+}
+
+func TestAuth_MaxAuthRounds_CountsTurns(t *testing.T) {
+	for _, max := range []int{0, 2} {
+		var writer io.Writer
+		s, err := New(&Config{AuthMethods: []Authenticator{splitWriteAuthenticator{&writer}}, MaxAuthRounds: max})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		client, server := net.Pipe()
+		go func() {
+			client.SetDeadline(time.Now().Add(time.Second))
+			client.Write([]byte{1, 1})
+			io.ReadFull(client, make([]byte, 2))
+			client.Write([]byte{0})
+			io.ReadFull(client, make([]byte, 4))
+			client.Write([]byte{0})
+		}()
+
+		if _, err := s.authenticate(server, server); err != nil {
+			t.Fatalf("max %d: err: %v", max, err)
+		}
+		// Without a limit the Authenticator gets the connection itself
+		if wrapped := writer != io.Writer(server); wrapped != (max > 0) {
+			t.Fatalf("max %d: bad writer: %T", max, writer)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,243 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Dialer connects to destinations through a SOCKS5 proxy
+type Dialer struct {
+	// ProxyNetwork and ProxyAddr locate the proxy server.
+	// ProxyNetwork defaults to "tcp".
+	ProxyNetwork string
+	ProxyAddr    string
+
+	// Username and Password enable username/password authentication.
+	// If Username is empty, only "auth-less" mode is offered.
+	Username string
+	Password string
+
+	// RemoteResolve sends host names to the proxy for resolution
+	// (the "socks5h" behavior) instead of resolving them locally.
+	// This prevents local DNS leaks and allows reaching names which
+	// only resolve from the proxy network.
+	RemoteResolve bool
+
+	// CompressPorts lists destination ports, e.g. 80, whose tunnel to the
+	// proxy is compressed. This needs a proxy of this package with
+	// Config.EnableCompression, other proxies are used uncompressed.
+	CompressPorts []int
+
+	// ProxyDial is used to connect to the proxy. Defaults to net.Dialer.
+	ProxyDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewTransport returns an http.Transport sending all requests through
+// the proxy at proxyAddr. An empty username disables authentication.
+// Host names are resolved by the proxy.
+func NewTransport(proxyAddr, username, password string) *http.Transport {
+	d := &Dialer{
+		ProxyAddr:     proxyAddr,
+		Username:      username,
+		Password:      password,
+		RemoteResolve: true,
+	}
+	return &http.Transport{
+		DialContext:         d.DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// Dial connects to addr through the proxy. Together with DialContext,
+// this makes a Dialer usable as a golang.org/x/net/proxy.Dialer and
+// proxy.ContextDialer.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy. Only TCP networks
+// are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %v", network)
+	}
+
+	dest, err := d.destination(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyNetwork := d.ProxyNetwork
+	if proxyNetwork == "" {
+		proxyNetwork = "tcp"
+	}
+	dial := d.ProxyDial
+	if dial == nil {
+		var nd net.Dialer
+		dial = nd.DialContext
+	}
+	conn, err := dial(ctx, proxyNetwork, d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the handshake by the context deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	command := ConnectCommand
+	if d.compresses(dest.Port) {
+		command = compressedConnectCommand
+	}
+	if err := d.handshake(conn, command, dest); err != nil {
+		conn.Close()
+		if err == errCompressionNotSupported {
+			// Fall back to an uncompressed tunnel
+			plain := *d
+			plain.CompressPorts = nil
+			return plain.DialContext(ctx, network, addr)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if command == compressedConnectCommand {
+		return newFlateConn(conn, conn), nil
+	}
+	return conn, nil
+}
+
+// compresses checks if the tunnel to a destination port is compressed
+func (d *Dialer) compresses(port int) bool {
+	for _, p := range d.CompressPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// destination builds the AddrSpec to request from the proxy
+func (d *Dialer) destination(ctx context.Context, network, addr string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port: %v", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	if d.RemoteResolve {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name too long: %v", host)
+		}
+		return &AddrSpec{FQDN: host, Port: port}, nil
+	}
+
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	return &AddrSpec{IP: ips[0], Port: port}, nil
+}
+
+// handshake negotiates auth and sends the CONNECT request
+func (d *Dialer) handshake(conn net.Conn, command uint8, dest *AddrSpec) error {
+	methods := []byte{NoAuth}
+	if d.Username != "" {
+		methods = []byte{UserPassAuth}
+	}
+	msg := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	// Read the selected method
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("Failed to get auth method: %v", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("Unsupported SOCKS version: %v", header[0])
+	}
+	switch header[1] {
+	case NoAuth:
+	case UserPassAuth:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return NoSupportedAuth
+	}
+
+	// Send the request
+	req, err := formatMessage(command, dest)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Read the reply
+	reply := []byte{0, 0, 0}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("Failed to get reply: %v", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Unsupported reply version: %v", reply[0])
+	}
+	if _, err := readAddrSpec(conn); err != nil {
+		return fmt.Errorf("Failed to read bound address: %v", err)
+	}
+	if reply[1] == commandNotSupported && command == compressedConnectCommand {
+		return errCompressionNotSupported
+	}
+	if reply[1] != successReply {
+		return fmt.Errorf("Connect to %v failed with reply code %v", dest, reply[1])
+	}
+	return nil
+}
+
+// authenticate performs RFC 1929 username/password authentication
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return fmt.Errorf("Username or password too long")
+	}
+	msg := []byte{userAuthVersion, byte(len(d.Username))}
+	msg = append(msg, d.Username...)
+	msg = append(msg, byte(len(d.Password)))
+	msg = append(msg, d.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	status := []byte{0, 0}
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("Failed to get auth status: %v", err)
+	}
+	if status[1] != authSuccess {
+		return UserAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoListener starts a listener echoing back everything it reads
+func echoListener(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// testServer is a Server listening on a random local port
+type testServer struct {
+	*Server
+	addr string
+}
+
+// startServerWith serves conf on a random local port
+func startServerWith(t *testing.T, conf *Config) *testServer {
+	if conf.Logger == nil {
+		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = time.Second
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := serv.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	return &testServer{serv, l.Addr().String()}
+}
+
+// startServer serves conf on a random local port and returns its address
+func startServer(t *testing.T, conf *Config) string {
+	return startServerWith(t, conf).addr
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte("ping")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestDialer_UserPass(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+
+	d := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	d.Password = "baz"
+	if _, err := d.Dial("tcp", echo.String()); err != UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestDialer_RemoteResolve(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{Resolver: staticResolver{echo.IP}})
+	addr := net.JoinHostPort("only.proxy.invalid", strconv.Itoa(echo.Port))
+
+	d := &Dialer{ProxyAddr: proxy}
+	if _, err := d.Dial("tcp", addr); err == nil {
+		t.Fatalf("expected local resolution to fail")
+	}
+
+	d.RemoteResolve = true
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func TestNewTransport(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer web.Close()
+	proxy := startServer(t, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+
+	client := &http.Client{Transport: NewTransport(proxy, "foo", "bar"), Timeout: time.Second}
+	resp, err := client.Get(web.URL)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("bad: %q", body)
+	}
+
+	// Wrong credentials fail the request
+	client = &http.Client{Transport: NewTransport(proxy, "foo", "baz"), Timeout: time.Second}
+	if _, err := client.Get(web.URL); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Clock is the source of time of a Server, see Config.Clock
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d, like time.AfterFunc
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by Clock.AfterFunc
+type Timer interface {
+	// Stop prevents the timer from firing, like time.Timer.Stop
+	Stop() bool
+}
+
+// realClock is the default Clock, backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clockTimeoutCtx is a context ended by a timer of a Clock. It has a
+// Done channel of its own rather than wrapping a context.WithCancel, so
+// contexts derived from it, e.g. with context.WithTimeout, end with its
+// Err instead of context.Canceled.
+type clockTimeoutCtx struct {
+	context.Context
+	done chan struct{}
+	once sync.Once
+	err  atomic.Value
+}
+
+func (c *clockTimeoutCtx) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports context.DeadlineExceeded once the timer fired, like the
+// context of context.WithTimeout
+func (c *clockTimeoutCtx) Err() error {
+	if err, ok := c.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// cancel ends the context with err unless it already ended
+func (c *clockTimeoutCtx) cancel(err error) {
+	c.once.Do(func() {
+		c.err.Store(err)
+		close(c.done)
+	})
+}
+
+// withClockTimeout is like context.WithTimeout with the time of clock.
+// The context has no Deadline as that time may not be the real one.
+func withClockTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	c := &clockTimeoutCtx{Context: ctx, done: make(chan struct{})}
+	timer := clock.AfterFunc(d, func() {
+		c.cancel(context.DeadlineExceeded)
+	})
+	if parent := ctx.Done(); parent != nil {
+		go func() {
+			select {
+			case <-parent:
+				c.cancel(ctx.Err())
+			case <-c.done:
+			}
+		}()
+	}
+	return c, func() {
+		timer.Stop()
+		c.cancel(context.Canceled)
+	}
+}
+
+// clock returns the Clock of the Server
+func (s *Server) clock() Clock {
+	if s.config.Clock != nil {
+		return s.config.Clock
+	}
+	return realClock{}
+}
@@ -0,0 +1,196 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeClock is a Clock only moving forward with Advance
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing the timers which are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			due = append(due, t.f)
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.lock.Unlock()
+
+	for _, f := range due {
+		go f()
+	}
+}
+
+// Pending returns the number of timers not fired or stopped yet
+func (c *fakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasPending := !t.stopped
+	t.stopped = true
+	return wasPending
+}
+
+func TestRateLimiter_Clock(t *testing.T) {
+	clock := newFakeClock()
+	r := newRateLimiter(2, clock)
+	if !r.allow("a") || !r.allow("a") || r.allow("a") {
+		t.Fatalf("expected burst of 2")
+	}
+
+	clock.Advance(400 * time.Millisecond)
+	if r.allow("a") {
+		t.Fatalf("bucket refilled too early")
+	}
+	clock.Advance(100 * time.Millisecond)
+	if !r.allow("a") {
+		t.Fatalf("bucket should refill")
+	}
+}
+
+func TestRequest_DenyTarpitClock(t *testing.T) {
+	clock := newFakeClock()
+	serv, err := New(&Config{
+		Rules:        PermitNone(),
+		DenyBehavior: DenyTarpit,
+		TarpitDelay:  time.Hour,
+		Clock:        clock,
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	go serv.ServeConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 1}
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for the tarpit to start its timer
+	for i := 0; clock.Pending() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("tarpit not started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+
+	out, err := io.ReadAll(client)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+}
+
+func TestSOCKS5_MaxConnDurationClock(t *testing.T) {
+	clock := newFakeClock()
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	serv := startServerWith(t, &Config{
+		MaxConnDuration: time.Hour,
+		Clock:           clock,
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	conn, err := (&Dialer{ProxyAddr: serv.addr}).Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// The relay only ends with the time of the clock
+	clock.Advance(time.Hour)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info := <-finished; info.CloseReason != CloseMaxDuration {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestWithClockTimeout_Children(t *testing.T) {
+	clock := newFakeClock()
+	ctx, cancel := withClockTimeout(context.Background(), clock, time.Hour)
+	defer cancel()
+	child, cancelChild := context.WithTimeout(ctx, 24*time.Hour)
+	defer cancelChild()
+	value := context.WithValue(child, requestKey{}, nil)
+
+	clock.Advance(time.Hour)
+	select {
+	case <-value.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("child not done")
+	}
+	for _, c := range []context.Context{ctx, child, value} {
+		if err := c.Err(); err != context.DeadlineExceeded {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
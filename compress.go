@@ -0,0 +1,54 @@
+package socks5
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+)
+
+// compressedConnectCommand is a CONNECT whose tunnel between client and
+// server is compressed. It is a private command outside of RFC 1928, so
+// servers unaware of it answer "command not supported" before any
+// compressed data is exchanged.
+const compressedConnectCommand = uint8(0x80)
+
+// errCompressionNotSupported is returned by handshake when the server
+// does not support compressed tunnels
+var errCompressionNotSupported = fmt.Errorf("Compression not supported by the proxy")
+
+// flateConn compresses what is written to and decompresses what is read
+// from the wrapped connection. Every Write is flushed, so interactive
+// protocols don't wait for a full compression block.
+type flateConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+// newFlateConn wraps conn, reading the compressed stream from r which
+// is either conn or a reader buffering it
+func newFlateConn(conn net.Conn, r io.Reader) *flateConn {
+	// NewWriter only fails for invalid levels
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &flateConn{Conn: conn, r: flate.NewReader(r), w: w}
+}
+
+func (c *flateConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	// Peers close the connection without ending the compressed stream
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *flateConn) Write(b []byte) (int, error) {
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialer_Compressed(t *testing.T) {
+	echo := echoListener(t)
+	var clientWritten int64
+	proxy := startServer(t, &Config{
+		EnableCompression: true,
+		WrapClientConn: func(c net.Conn) net.Conn {
+			return countingConn{c, &clientWritten}
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, CompressPorts: []int{echo.Port}}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// Compressible data crosses the tunnel compressed
+	before := atomic.LoadInt64(&clientWritten)
+	data := bytes.Repeat([]byte("compressible "), 4096)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	go conn.Write(data)
+	out := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("bad echo")
+	}
+	if n := atomic.LoadInt64(&clientWritten) - before; n >= int64(len(data))/10 {
+		t.Fatalf("not compressed: %v of %v bytes", n, len(data))
+	}
+}
+
+func TestDialer_CompressedFallback(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{})
+
+	// The proxy doesn't support compression, so it is not used
+	d := &Dialer{ProxyAddr: proxy, CompressPorts: []int{echo.Port}}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*flateConn); ok {
+		t.Fatalf("expected uncompressed conn")
+	}
+	testEcho(t, conn)
+}
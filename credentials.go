@@ -5,6 +5,14 @@ type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// RemoteCredentialStore can be implemented by a CredentialStore which
+// validates credentials against the remote address of the client.
+// UserPassAuthenticator uses ValidFrom instead of Valid when available.
+type RemoteCredentialStore interface {
+	CredentialStore
+	ValidFrom(user, password string, remote *AddrSpec) bool
+}
+
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
@@ -15,3 +23,54 @@ func (s StaticCredentials) Valid(user, password string) bool {
 	}
 	return password == pass
 }
+
+// HasUser reports whether user is in the map, see UserLister
+func (s StaticCredentials) HasUser(user string) bool {
+	_, ok := s[user]
+	return ok
+}
+
+// UserLister can be implemented by a CredentialStore which can tell
+// whether it knows a user, so a ChainCredentialStore stops at it.
+type UserLister interface {
+	HasUser(user string) bool
+}
+
+// CredentialStoreFunc adapts a function to a CredentialStore, e.g. to
+// validate against an LDAP directory
+type CredentialStoreFunc func(user, password string) bool
+
+func (f CredentialStoreFunc) Valid(user, password string) bool {
+	return f(user, password)
+}
+
+// ChainCredentialStore tries each CredentialStore in order until one
+// validates the credentials. The first store which knows the user, as
+// told by UserLister, decides, so its users are not looked up in later
+// stores. Stores which can't tell are skipped when they deny. A user
+// should therefore exist in one store only.
+type ChainCredentialStore []CredentialStore
+
+func (c ChainCredentialStore) Valid(user, password string) bool {
+	return c.ValidFrom(user, password, nil)
+}
+
+// ValidFrom uses the ValidFrom of the stores which implement
+// RemoteCredentialStore when remote is known
+func (c ChainCredentialStore) ValidFrom(user, password string, remote *AddrSpec) bool {
+	for _, store := range c {
+		var valid bool
+		if rstore, ok := store.(RemoteCredentialStore); ok && remote != nil {
+			valid = rstore.ValidFrom(user, password, remote)
+		} else {
+			valid = store.Valid(user, password)
+		}
+		if valid {
+			return true
+		}
+		if lister, ok := store.(UserLister); ok && lister.HasUser(user) {
+			return false
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"fmt"
+	"net"
 	"testing"
 )
 
@@ -22,3 +24,48 @@ func TestStaticCredentials(t *testing.T) {
 		t.Fatalf("expect invalid")
 	}
 }
+
+func TestChainCredentialStore(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	chain := ChainCredentialStore{
+		StaticCredentials{"foo": "bar"},
+		CredentialStoreFunc(func(user, password string) bool {
+			return user == "baz" && password == "qux"
+		}),
+		pinnedCredentials{StaticCredentials{"local": "pass"}, loopback},
+	}
+
+	if !chain.Valid("foo", "bar") || !chain.Valid("baz", "qux") {
+		t.Fatalf("expect valid")
+	}
+
+	// The first store knowing the user decides
+	if chain.Valid("foo", "qux") {
+		t.Fatalf("expect invalid")
+	}
+	if chain.Valid("nobody", "bar") {
+		t.Fatalf("expect invalid")
+	}
+
+	// Remote addresses are passed on
+	if !chain.ValidFrom("local", "pass", &AddrSpec{IP: net.IPv4(127, 0, 0, 1)}) {
+		t.Fatalf("expect valid")
+	}
+	if chain.ValidFrom("local", "pass", &AddrSpec{IP: net.IPv4(10, 0, 0, 1)}) {
+		t.Fatalf("expect invalid")
+	}
+}
+
+func ExampleChainCredentialStore() {
+	// lookupLDAP stands in for a bind against a directory server
+	lookupLDAP := func(user, password string) bool {
+		return user == "alice" && password == "secret"
+	}
+
+	creds := ChainCredentialStore{
+		StaticCredentials{"admin": "changeme"},
+		CredentialStoreFunc(lookupLDAP),
+	}
+	fmt.Println(creds.Valid("admin", "changeme"), creds.Valid("alice", "secret"))
+	// Output: true true
+}
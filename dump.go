@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"io"
+	"net"
+)
+
+// dumpConn logs the first bytes read from the wrapped connection, see
+// Config.DebugDumpBytes. Nothing is buffered, the bytes are logged as
+// they are read, and once enough were logged copying out of it is as
+// fast as copying out of the wrapped connection.
+type dumpConn struct {
+	net.Conn
+	s         *Server
+	label     string
+	remaining int
+}
+
+// dumpConn wraps conn to log the first DebugDumpBytes read from it,
+// or returns conn if dumps are disabled
+func (s *Server) dumpConn(conn net.Conn, req *Request, direction string) net.Conn {
+	n := s.config.DebugDumpBytes
+	if n <= 0 {
+		return conn
+	}
+	label := req.ConnID + " " + direction
+	if user := req.AuthContext.username(); user != "" {
+		label += " (user: " + s.logUsername(user) + ")"
+	}
+	return &dumpConn{Conn: conn, s: s, label: label, remaining: n}
+}
+
+func (c *dumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dump(b[:n])
+	return n, err
+}
+
+// dump logs what is left to log of b
+func (c *dumpConn) dump(b []byte) {
+	if c.remaining <= 0 || len(b) == 0 {
+		return
+	}
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	c.remaining -= len(b)
+	c.s.config.Logger.Printf("[DEBUG] socks: %s %d bytes: %x", c.label, len(b), b)
+}
+
+// WriteTo implements io.WriterTo, reading at most what is left to log
+// at once, then copying out of the wrapped connection
+func (c *dumpConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if c.remaining > 0 {
+		buf := make([]byte, c.remaining)
+		for c.remaining > 0 {
+			n, err := c.Read(buf[:c.remaining])
+			if n > 0 {
+				m, werr := w.Write(buf[:n])
+				written += int64(m)
+				if werr != nil {
+					return written, werr
+				}
+			}
+			if err == io.EOF {
+				return written, nil
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	n, err := io.Copy(w, c.Conn)
+	return written + n, err
+}
+
+// ReadFrom implements io.ReaderFrom so that relaying into the wrapped
+// connection stays zero-copy
+func (c *dumpConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// CloseWrite and CloseRead half-close the wrapped connection like
+// MeteredConn does
+func (c *dumpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func (c *dumpConn) CloseRead() error {
+	if cr, ok := c.Conn.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5_DebugDumpBytes(t *testing.T) {
+	echo := echoListener(t)
+	var logs bytes.Buffer
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		DebugDumpBytes: 4,
+		Logger:         log.New(&logs, "", 0),
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello world")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(conn, out); err != nil || string(out) != "hello world" {
+		t.Fatalf("bad: %q %v", out, err)
+	}
+	conn.Close()
+	info := <-finished
+
+	// Only the first 4 bytes of each direction are dumped
+	dumps := logs.String()
+	if strings.Count(dumps, "[DEBUG]") != 2 || strings.Count(dumps, "4 bytes: 68656c6c\n") != 2 {
+		t.Fatalf("bad: %q", dumps)
+	}
+	for _, direction := range []string{"client->server", "server->client"} {
+		if !strings.Contains(dumps, info.ConnID+" "+direction) {
+			t.Fatalf("missing %v: %q", direction, dumps)
+		}
+	}
+	if info.BytesSent != 11 || info.BytesReceived != 11 {
+		t.Fatalf("bad: %v %v", info.BytesSent, info.BytesReceived)
+	}
+}
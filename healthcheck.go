@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// healthCheckConnID is the ConnID of the requests made by HealthCheck
+const healthCheckConnID = "healthcheck"
+
+// HealthCheck dials probeAddr, a "host:port" address, the way a CONNECT
+// to it would be dialed: the host is resolved with the configured
+// resolver, checked against the OutboundNetwork and the connection is
+// made with Config.DialFunc or Config.Dial, so a broken resolver or
+// upstream proxy fails the check. The connection is closed as soon as it
+// is established. Rules, rewriting and authentication are not involved,
+// the resolution is counted in Stats.Resolutions like any other.
+// Dialing is bounded by ctx and by Config.ConnectTimeout when set.
+func (s *Server) HealthCheck(ctx context.Context, probeAddr string) error {
+	host, portStr, err := net.SplitHostPort(probeAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid probe address %q: %v", probeAddr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xffff {
+		return fmt.Errorf("Invalid probe port %q", portStr)
+	}
+	dest := &AddrSpec{Port: port}
+	if ip, zone := parseZonedIP(host); ip != nil {
+		dest.IP, dest.Zone = ip, zone
+	} else {
+		dest.FQDN = host
+	}
+	req := &Request{
+		Version:      socks5Version,
+		Command:      ConnectCommand,
+		ConnID:       healthCheckConnID,
+		DestAddr:     dest,
+		realDestAddr: dest,
+	}
+
+	timeout := s.config.ConnectTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	network := s.outboundNetwork()
+	ctx = context.WithValue(ctx, outboundNetworkKey{}, network)
+	ctx = context.WithValue(ctx, requestKey{}, req)
+
+	if ctx, err = s.resolveDest(ctx, nil, req, dest, network); err != nil {
+		return err
+	}
+	if err := s.checkReachable(nil, req, dest, network); err != nil {
+		return err
+	}
+
+	dial, dialer := s.dialFunc(req, timeout)
+	target, err := dialCandidates(ctx, dial, network, req)
+	if err != nil {
+		return fmt.Errorf("Failed to dial probe %v: %v", dest, err)
+	}
+	if target == nil {
+		return fmt.Errorf("%s returned neither a connection nor an error", dialer)
+	}
+	target.Close()
+	return nil
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHealthCheck(t *testing.T) {
+	echo := echoListener(t)
+	var dialed []string
+	serv, err := New(&Config{
+		Resolver:       staticResolver{net.IPv4(127, 0, 0, 1)},
+		ConnectTimeout: time.Second,
+		DialFunc: func(ctx context.Context, req *Request, net_, addr string) (net.Conn, error) {
+			dialed = append(dialed, req.ConnID+" "+addr)
+			return net.Dial(net_, addr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	probe := net.JoinHostPort("probe.example", strconv.Itoa(echo.Port))
+	if err := serv.HealthCheck(context.Background(), probe); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(dialed) != 1 || dialed[0] != healthCheckConnID+" "+echo.String() {
+		t.Fatalf("bad: %v", dialed)
+	}
+	if r := serv.Stats().Resolutions["socks5.staticResolver"]; r.Successes != 1 {
+		t.Fatalf("bad: %v", serv.Stats().Resolutions)
+	}
+
+	// A broken upstream fails the check
+	serv.config.DialFunc = func(ctx context.Context, req *Request, net_, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("upstream down")
+	}
+	err = serv.HealthCheck(context.Background(), probe)
+	if err == nil || !strings.Contains(err.Error(), "upstream down") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// So does a broken resolver
+	serv.SetResolver(failingResolver{})
+	err = serv.HealthCheck(context.Background(), probe)
+	if err == nil || !strings.Contains(err.Error(), "Failed to resolve") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// And an address the OutboundNetwork can't reach
+	serv.config.OutboundNetwork = "tcp6"
+	err = serv.HealthCheck(context.Background(), echo.String())
+	if err == nil || !strings.Contains(err.Error(), "not reachable") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if err := serv.HealthCheck(context.Background(), "no-port"); err == nil {
+		t.Fatalf("expected invalid probe address")
+	}
+}
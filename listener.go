@@ -0,0 +1,45 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+// ListenerConfig overrides the Server configuration for the connections
+// of a single listener, so one Server can e.g. serve an internal port
+// without authentication and a public one with it. Unset fields fall
+// back to the Server configuration.
+type ListenerConfig struct {
+	// Name identifies the listener in logs and Request.Listener
+	Name string
+
+	// AuthMethods replaces Config.AuthMethods
+	AuthMethods []Authenticator
+
+	// Rules replaces the RuleSet of the Server
+	Rules RuleSet
+}
+
+// listenerConfig is a ListenerConfig prepared for serving
+type listenerConfig struct {
+	name        string
+	authMethods map[uint8]Authenticator
+	rules       RuleSet
+}
+
+// ServeListener is like Serve, applying the overrides of lc to every
+// connection accepted on l. It returns an error right away if lc is
+// invalid or the address of l is already served.
+func (s *Server) ServeListener(l net.Listener, lc ListenerConfig) error {
+	conf := &listenerConfig{name: lc.Name, rules: lc.Rules}
+	if len(lc.AuthMethods) > 0 {
+		conf.authMethods = make(map[uint8]Authenticator)
+		for _, a := range lc.AuthMethods {
+			if _, ok := conf.authMethods[a.GetCode()]; ok {
+				return fmt.Errorf("Duplicate auth method: %v", a.GetCode())
+			}
+			conf.authMethods[a.GetCode()] = a
+		}
+	}
+	return s.serve(l, conf)
+}
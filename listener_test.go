@@ -0,0 +1,205 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeListener(t *testing.T) {
+	echo := echoListener(t)
+	public := startServerWith(t, &Config{Credentials: StaticCredentials{"foo": "bar"}})
+
+	// An internal listener of the same Server without authentication
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go public.ServeListener(l, ListenerConfig{
+		Name:        "internal",
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+	})
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	d.ProxyAddr = public.addr
+	if _, err := d.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected the public listener to require auth")
+	}
+}
+
+func TestServeListener_Rules(t *testing.T) {
+	echo := echoListener(t)
+	serv := startServerWith(t, &Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeListener(l, ListenerConfig{Name: "locked", Rules: PermitNone()})
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	if _, err := d.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected rule failure")
+	}
+}
+
+// errListener fails to accept with each of errs, then reports being closed
+type errListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *errListener) Close() error {
+	return nil
+}
+
+// temporaryError is a net.Error like EMFILE
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServeListener_AcceptErrors(t *testing.T) {
+	var infos []AcceptErrorInfo
+	serv, err := New(&Config{
+		OnAcceptError: func(info AcceptErrorInfo) {
+			infos = append(infos, info)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l := &errListener{errs: []error{temporaryError{}, fmt.Errorf("broken")}}
+	serv.ServeListener(l, ListenerConfig{Name: "internal"})
+	if len(infos) != 2 {
+		t.Fatalf("bad: %v", infos)
+	}
+	if !infos[0].Temporary || infos[0].Listener != "internal" || infos[0].Error != (temporaryError{}) {
+		t.Fatalf("bad: %#v", infos[0])
+	}
+	if infos[1].Temporary || infos[1].Error.Error() != "broken" {
+		t.Fatalf("bad: %#v", infos[1])
+	}
+}
+
+func TestServeListener_DuplicateAddress(t *testing.T) {
+	serv := startServerWith(t, &Config{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.ServeListener(l, ListenerConfig{Name: "first"})
+	time.Sleep(10 * time.Millisecond)
+
+	// The same socket served a second time
+	err = serv.ServeListener(l, ListenerConfig{Name: "second"})
+	if err == nil || !strings.Contains(err.Error(), l.Addr().String()) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The first accept loop keeps serving
+	echo := echoListener(t)
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+// leakyListener admits accepted connections at the constant rate of its
+// ticker, like a leaky bucket, smoothing out bursts of new connections
+type leakyListener struct {
+	net.Listener
+	ticker *time.Ticker
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newLeakyListener(l net.Listener, interval time.Duration) *leakyListener {
+	return &leakyListener{Listener: l, ticker: time.NewTicker(interval), closed: make(chan struct{})}
+}
+
+func (l *leakyListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.ticker.C:
+	case <-l.closed:
+		// Fall through to the error of the closed listener
+	}
+	return l.Listener.Accept()
+}
+
+func (l *leakyListener) Close() error {
+	l.once.Do(func() {
+		l.ticker.Stop()
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func ExampleConfig_listenerWrapper() {
+	serv, err := New(&Config{
+		// Accept at most 100 connections per second, also when using
+		// the convenience ListenAndServe
+		ListenerWrapper: func(l net.Listener) net.Listener {
+			return newLeakyListener(l, 10*time.Millisecond)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	serv.ListenAndServe("tcp", []string{"127.0.0.1:1080"})
+}
+
+func TestListenerWrapper(t *testing.T) {
+	echo := echoListener(t)
+	var wrapped int32
+	serv := startServerWith(t, &Config{
+		ListenerWrapper: func(l net.Listener) net.Listener {
+			atomic.AddInt32(&wrapped, 1)
+			return newLeakyListener(l, 50*time.Millisecond)
+		},
+	})
+	defer serv.Close()
+	if n := atomic.LoadInt32(&wrapped); n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Connections are admitted at the rate of the wrapper
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := (&Dialer{ProxyAddr: serv.addr}).Dial("tcp", echo.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("accepted too fast: %v", d)
+	}
+}
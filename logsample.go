@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"sync"
+)
+
+// logSampler limits how many messages of each kind are logged per second
+type logSampler struct {
+	lock  sync.Mutex
+	kinds map[string]*logKind
+}
+
+// logKind counts the messages of a kind in the current second
+type logKind struct {
+	second  int64
+	logged  int
+	dropped int
+}
+
+// allow reports whether a message of kind may be logged at now, with
+// limit messages per second. dropped is the number of messages of the
+// kind dropped since the last one which was allowed.
+func (l *logSampler) allow(kind string, limit int, now int64) (ok bool, dropped int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.kinds == nil {
+		l.kinds = make(map[string]*logKind)
+	}
+	k := l.kinds[kind]
+	if k == nil {
+		k = &logKind{}
+		l.kinds[kind] = k
+	}
+	if k.second != now {
+		k.second = now
+		k.logged = 0
+	}
+	if k.logged >= limit {
+		k.dropped++
+		return false, 0
+	}
+	k.logged++
+	dropped, k.dropped = k.dropped, 0
+	return true, dropped
+}
+
+// logf logs a message of the given kind, subject to Config.MaxLogsPerSec.
+// The number of dropped messages is logged with the next one logged.
+func (s *Server) logf(kind, format string, args ...interface{}) {
+	if limit := s.config.MaxLogsPerSec; limit > 0 {
+		ok, dropped := s.logSampler.allow(kind, limit, s.clock().Now().Unix())
+		if !ok {
+			return
+		}
+		if dropped > 0 {
+			s.config.Logger.Printf("[WARN] socks: Dropped %d %s messages over MaxLogsPerSec", dropped, kind)
+		}
+	}
+	s.config.Logger.Printf(format, args...)
+}
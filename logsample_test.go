@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5_MaxLogsPerSec(t *testing.T) {
+	var logs bytes.Buffer
+	serv, err := New(&Config{
+		MaxLogsPerSec: 2,
+		Logger:        log.New(&logs, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Start at a new second, so all connections fall into it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	for i := 0; i < 5; i++ {
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			client.Write([]byte{4})
+		}()
+		serv.ServeConn(server)
+	}
+	if n := strings.Count(logs.String(), "Unsupported SOCKS version"); n != 2 {
+		t.Fatalf("bad: %v", logs.String())
+	}
+
+	// The next second starts over and tells what was dropped
+	serv.logSampler.kinds["handshake"].second--
+	serv.logf("handshake", "[ERR] socks: next")
+	if out := logs.String(); !strings.Contains(out, "Dropped 3 handshake messages") || !strings.HasSuffix(out, "next\n") {
+		t.Fatalf("bad: %v", out)
+	}
+}
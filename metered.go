@@ -0,0 +1,116 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// MeteredConn wraps a net.Conn and atomically counts the bytes
+// read from and written to it
+type MeteredConn struct {
+	net.Conn
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// NewMeteredConn wraps conn into a MeteredConn
+func NewMeteredConn(conn net.Conn) *MeteredConn {
+	return &MeteredConn{Conn: conn}
+}
+
+func (m *MeteredConn) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	atomic.AddInt64(&m.bytesRead, int64(n))
+	return n, err
+}
+
+func (m *MeteredConn) Write(b []byte) (int, error) {
+	n, err := m.Conn.Write(b)
+	atomic.AddInt64(&m.bytesWritten, int64(n))
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom so that relaying into a MeteredConn
+// keeps the zero-copy path of the underlying connection (splice on Linux).
+// Counters are updated as the bytes move, see meteredCopy.
+func (m *MeteredConn) ReadFrom(r io.Reader) (int64, error) {
+	src := r
+	meter, ok := r.(*MeteredConn)
+	if ok {
+		src = meter.Conn
+	}
+	return meteredCopy(m.Conn, src, func(n int64) {
+		atomic.AddInt64(&m.bytesWritten, n)
+		if meter != nil {
+			atomic.AddInt64(&meter.bytesRead, n)
+		}
+	})
+}
+
+// WriteTo implements io.WriterTo so that relaying out of a MeteredConn
+// keeps the zero-copy path of the underlying connection (splice on Linux).
+// Counters are updated as the bytes move, see meteredCopy.
+func (m *MeteredConn) WriteTo(w io.Writer) (int64, error) {
+	dst := w
+	meter, ok := w.(*MeteredConn)
+	if ok {
+		dst = meter.Conn
+	}
+	return meteredCopy(dst, m.Conn, func(n int64) {
+		atomic.AddInt64(&m.bytesRead, n)
+		if meter != nil {
+			atomic.AddInt64(&meter.bytesWritten, n)
+		}
+	})
+}
+
+// meteredCopy copies src to dst like io.Copy, calling count after every
+// relayBufferSize bytes at most. The chunks are io.LimitedReaders, which
+// net.TCPConn still splices.
+func meteredCopy(dst io.Writer, src io.Reader, count func(n int64)) (int64, error) {
+	var written int64
+	for {
+		n, err := io.CopyN(dst, src, relayBufferSize)
+		written += n
+		count(n)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// BytesRead returns the number of bytes read so far
+func (m *MeteredConn) BytesRead() int64 {
+	return atomic.LoadInt64(&m.bytesRead)
+}
+
+// BytesWritten returns the number of bytes written so far
+func (m *MeteredConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&m.bytesWritten)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection
+// if it supports half-close, otherwise it closes the connection
+func (m *MeteredConn) CloseWrite() error {
+	if cw, ok := m.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return m.Conn.Close()
+}
+
+// CloseRead shuts down the reading side of the underlying connection
+// if it supports half-close, otherwise it is a no-op
+func (m *MeteredConn) CloseRead() error {
+	if cr, ok := m.Conn.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+type closeReader interface {
+	CloseRead() error
+}
@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMeteredConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	m := NewMeteredConn(server)
+
+	go func() {
+		client.Write([]byte("ping"))
+		buf := make([]byte, 6)
+		io.ReadFull(client, buf)
+	}()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(m, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := m.Write([]byte("pong!!")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if m.BytesRead() != 4 {
+		t.Fatalf("bad: %v", m.BytesRead())
+	}
+	if m.BytesWritten() != 6 {
+		t.Fatalf("bad: %v", m.BytesWritten())
+	}
+}
+
+func TestMeteredConn_CloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+
+	m := NewMeteredConn(conn)
+	if err := m.CloseWrite(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The peer sees EOF while our read side stays open
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := peer.Write([]byte("x")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := m.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestMeteredConn_ReadFrom(t *testing.T) {
+	srcClient, srcServer := tcpPair(t)
+	dstClient, dstServer := tcpPair(t)
+	defer srcServer.Close()
+	defer dstClient.Close()
+	defer dstServer.Close()
+
+	src := NewMeteredConn(srcServer)
+	dst := NewMeteredConn(dstClient)
+
+	go func() {
+		srcClient.Write([]byte("hello"))
+		srcClient.Close()
+	}()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 5 || src.BytesRead() != 5 || dst.BytesWritten() != 5 {
+		t.Fatalf("bad: %v %v %v", n, src.BytesRead(), dst.BytesWritten())
+	}
+}
+
+func TestMeteredConn_ReadFrom_CountsAsItCopies(t *testing.T) {
+	srcClient, srcServer := tcpPair(t)
+	dstClient, dstServer := tcpPair(t)
+	defer srcClient.Close()
+	defer srcServer.Close()
+	defer dstClient.Close()
+	defer dstServer.Close()
+	go io.Copy(io.Discard, dstServer)
+
+	src := NewMeteredConn(srcServer)
+	dst := NewMeteredConn(dstClient)
+	go io.Copy(dst, src)
+
+	// The counters follow the data while the copy is still running
+	data := make([]byte, 2*relayBufferSize)
+	if _, err := srcClient.Write(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for src.BytesRead() != int64(len(data)) || dst.BytesWritten() != int64(len(data)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v %v", src.BytesRead(), dst.BytesWritten())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
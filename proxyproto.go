@@ -0,0 +1,102 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxProxyHeaderLen is the maximum length of a PROXY protocol v1 header
+const maxProxyHeaderLen = 107
+
+// proxiedConn overrides the remote address of a connection with the
+// client address announced in a PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (p *proxiedConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// parseTrustedCIDRs parses the networks allowed to send PROXY headers
+func parseTrustedCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY protocol trusted CIDR: %v", err)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// trustsProxyHeader checks if conn comes from a peer allowed to send
+// a PROXY protocol header
+func (s *Server) trustsProxyHeader(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range s.proxyTrusted {
+		if network.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads an optional PROXY protocol v1 header from a
+// trusted peer and returns conn with the announced remote address
+func (s *Server) readProxyHeader(conn net.Conn, bufConn *bufio.Reader) (net.Conn, error) {
+	if !s.trustsProxyHeader(conn) {
+		return conn, nil
+	}
+	first, err := bufConn.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != 'P' {
+		return conn, nil
+	}
+
+	var line []byte
+	for len(line) < maxProxyHeaderLen {
+		b, err := bufConn.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !strings.HasSuffix(string(line), "\r\n") {
+		return nil, fmt.Errorf("Invalid PROXY header: too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("Invalid PROXY header: %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return conn, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol: %v", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("Invalid PROXY header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid PROXY header: %q", line)
+	}
+	return &proxiedConn{conn, &net.TCPAddr{IP: ip, Port: port}}, nil
+}
@@ -0,0 +1,83 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type remoteRecorder struct {
+	remotes chan *AddrSpec
+}
+
+func (r *remoteRecorder) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.remotes <- req.RemoteAddr
+	return ctx, false
+}
+
+func sendProxiedRequest(t *testing.T, addr string, header string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte(header))
+	conn.Write([]byte{5, 1, NoAuth})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write([]byte{5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 80})
+	io.ReadFull(conn, make([]byte, 10))
+}
+
+func TestProxyProtocol_Trusted(t *testing.T) {
+	rules := &remoteRecorder{make(chan *AddrSpec, 1)}
+	proxy := startServer(t, &Config{
+		Rules:                     rules,
+		ProxyProtocolTrustedCIDRs: []string{"127.0.0.0/8"},
+	})
+
+	sendProxiedRequest(t, proxy, "PROXY TCP4 203.0.113.7 127.0.0.1 5555 1080\r\n")
+	select {
+	case remote := <-rules.remotes:
+		if !remote.IP.Equal(net.ParseIP("203.0.113.7")) || remote.Port != 5555 {
+			t.Fatalf("bad: %v", remote)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not evaluated")
+	}
+
+	// The header stays optional for trusted peers
+	sendProxiedRequest(t, proxy, "")
+	select {
+	case remote := <-rules.remotes:
+		if !remote.IP.IsLoopback() {
+			t.Fatalf("bad: %v", remote)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not evaluated")
+	}
+}
+
+func TestProxyProtocol_Untrusted(t *testing.T) {
+	rules := &remoteRecorder{make(chan *AddrSpec, 1)}
+	proxy := startServer(t, &Config{
+		Rules:                     rules,
+		ProxyProtocolTrustedCIDRs: []string{"10.0.0.0/8"},
+	})
+
+	sendProxiedRequest(t, proxy, "PROXY TCP4 203.0.113.7 127.0.0.1 5555 1080\r\n")
+	select {
+	case remote := <-rules.remotes:
+		t.Fatalf("spoofed request was evaluated: %v", remote)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProxyProtocol_InvalidCIDR(t *testing.T) {
+	if _, err := New(&Config{ProxyProtocolTrustedCIDRs: []string{"nope"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
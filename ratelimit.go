@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often idle buckets are dropped
+const rateSweepInterval = time.Minute
+
+// maxRateBuckets bounds the buckets of a rateLimiter between sweeps, e.g.
+// against clients spread over many IPv6 addresses
+const maxRateBuckets = 64 * 1024
+
+// tokenBucket is the state of a single key of a rateLimiter
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per key, e.g. per client IP. Once
+// there are maxBuckets, the least recently used bucket is evicted for a
+// new key, which then starts with a full burst.
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	clock      Clock
+	maxBuckets int
+
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the buckets, the most recently used in front
+	lru       *list.List
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate events per second
+// per key, a nil limiter is returned for a non-positive (unlimited) rate.
+// The clock defaults to the time package if nil.
+func newRateLimiter(rate float64, clock Clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &rateLimiter{
+		rate:       rate,
+		burst:      math.Max(1, math.Ceil(rate)),
+		clock:      clock,
+		maxBuckets: maxRateBuckets,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// allow takes a token from the bucket of key if one is available
+func (r *rateLimiter) allow(key string) bool {
+	if r == nil {
+		return true
+	}
+	now := r.clock.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now.Sub(r.lastSweep) > rateSweepInterval {
+		r.sweep(now)
+	}
+
+	var b *tokenBucket
+	if e, ok := r.buckets[key]; ok {
+		r.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		if len(r.buckets) >= r.maxBuckets {
+			r.remove(r.lru.Back())
+		}
+		b = &tokenBucket{key: key, tokens: r.burst, last: now}
+		r.buckets[key] = r.lru.PushFront(b)
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets which refilled completely, they are
+// indistinguishable from new ones
+func (r *rateLimiter) sweep(now time.Time) {
+	r.lastSweep = now
+	for _, e := range r.buckets {
+		if b := e.Value.(*tokenBucket); b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			r.remove(e)
+		}
+	}
+}
+
+// remove drops the bucket of e
+func (r *rateLimiter) remove(e *list.Element) {
+	delete(r.buckets, r.lru.Remove(e).(*tokenBucket).key)
+}
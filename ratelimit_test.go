@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(2, nil)
+	if !r.allow("a") || !r.allow("a") {
+		t.Fatalf("burst should be allowed")
+	}
+	if r.allow("a") {
+		t.Fatalf("expected limit")
+	}
+	if !r.allow("b") {
+		t.Fatalf("keys should be limited separately")
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if !r.allow("a") {
+		t.Fatalf("bucket should refill")
+	}
+
+	// Unlimited
+	none := newRateLimiter(0, nil)
+	for i := 0; i < 10; i++ {
+		if !none.allow("a") {
+			t.Fatalf("expected no limit")
+		}
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	r := newRateLimiter(100, nil)
+	r.allow("a")
+	time.Sleep(20 * time.Millisecond)
+	r.sweep(time.Now())
+	if len(r.buckets) != 0 {
+		t.Fatalf("refilled bucket not dropped: %v", r.buckets)
+	}
+}
+
+func TestSOCKS5_MaxNewConnsPerSec(t *testing.T) {
+	serv, err := New(&Config{
+		MaxNewConnsPerSec: 1,
+		Logger:            log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		client.Close()
+		serv.ServeConn(server)
+	}
+	if n := serv.Stats().RateLimited; n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestRateLimiter_MaxBuckets(t *testing.T) {
+	clock := newFakeClock()
+	r := newRateLimiter(1, clock)
+	r.maxBuckets = 2
+	r.allow("a")
+	r.allow("b")
+	r.allow("a")
+
+	// The least recently used bucket makes room for a new key
+	r.allow("c")
+	if len(r.buckets) != 2 || r.buckets["b"] != nil {
+		t.Fatalf("bad: %v", r.buckets)
+	}
+	if r.allow("a") {
+		t.Fatalf("recently used bucket was evicted")
+	}
+}
@@ -1,11 +1,15 @@
 package socks5
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -34,6 +38,13 @@ const (
 
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
+
+	// errIdleTimeout ends a relay without data for the IdleTimeout,
+	// it is not reported as a failure
+	errIdleTimeout = fmt.Errorf("Idle timeout")
+
+	// RelayStalled is returned when a relay is closed by the StallTimeout
+	RelayStalled = fmt.Errorf("Relay stalled, peer is not reading")
 )
 
 // AddressRewriter is used to rewrite a destination transparently
@@ -41,26 +52,121 @@ type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
 }
 
+// UnresolvedRewriter can be implemented by an AddressRewriter which
+// replaces some destinations whatever they resolve to, e.g. with UNIX
+// domain sockets or fixed routes. When SkipResolve returns true the
+// requested name is not resolved before Rewrite is invoked, so it need
+// not resolve and isn't passed to the Resolver.
+type UnresolvedRewriter interface {
+	SkipResolve(request *Request) bool
+}
+
 // AddrSpec is used to return the target AddrSpec
 // which may be specified as IPv4, IPv6, or a FQDN
 type AddrSpec struct {
 	FQDN string
 	IP   net.IP
+	// Zone is the IPv6 zone of a link-local IP, e.g. "eth0". The SOCKS
+	// protocol can't carry it, clients send it as part of an IP literal
+	// domain name such as "fe80::1%eth0", or a Rewriter sets it.
+	Zone string
 	Port int
+	// UnixSocket is the path of a UNIX domain socket. When set, it is
+	// dialed instead of the IP or FQDN. Only a Rewriter can set it.
+	UnixSocket string
+}
+
+// NewAddrSpec returns the AddrSpec of a TCP, UDP or UNIX address, or of
+// another net.Addr whose String is an IP and port, nil otherwise
+func NewAddrSpec(addr net.Addr) *AddrSpec {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return &AddrSpec{IP: addr.IP, Zone: addr.Zone, Port: addr.Port}
+	case *net.UDPAddr:
+		return &AddrSpec{IP: addr.IP, Zone: addr.Zone, Port: addr.Port}
+	case *net.UnixAddr:
+		return &AddrSpec{UnixSocket: addr.Name}
+	case nil:
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip, zone := parseZonedIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &AddrSpec{IP: ip, Zone: zone, Port: port}
+}
+
+// parseZonedIP parses an IP literal with an optional IPv6 zone such as
+// "fe80::1%eth0", returning a nil IP if s is not one
+func parseZonedIP(s string) (net.IP, string) {
+	host, zone := s, ""
+	if i := strings.LastIndexByte(s, '%'); i > 0 {
+		host, zone = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
 }
 
+// ipString returns the IP with its zone, if any
+func (a AddrSpec) ipString() string {
+	if a.Zone != "" {
+		return a.IP.String() + "%" + a.Zone
+	}
+	return a.IP.String()
+}
+
+// String returns host:port, with IPv6 addresses in brackets. For
+// FQDNs the IP, if resolved, is added in parentheses.
 func (a *AddrSpec) String() string {
+	if a.UnixSocket != "" {
+		return fmt.Sprintf("unix:%s", a.UnixSocket)
+	}
 	if a.FQDN != "" {
-		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
+		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.ipString(), a.Port)
 	}
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return net.JoinHostPort(a.ipString(), strconv.Itoa(a.Port))
+}
+
+// Network returns "unix" for UNIX domain sockets and "tcp" otherwise,
+// which makes AddrSpec a net.Addr
+func (a *AddrSpec) Network() string {
+	if a.UnixSocket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Equal reports whether a and other are the same address. An FQDN only
+// equals the same FQDN, regardless of what it resolved to.
+func (a *AddrSpec) Equal(other *AddrSpec) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	if a.UnixSocket != "" || other.UnixSocket != "" {
+		return a.UnixSocket == other.UnixSocket
+	}
+	if a.Port != other.Port || a.FQDN != other.FQDN {
+		return false
+	}
+	return a.FQDN != "" || (a.IP.Equal(other.IP) && a.Zone == other.Zone)
 }
 
 // Address returns a string suitable to dial; prefer returning IP-based
-// address, fallback to FQDN
+// address, fallback to FQDN. For UNIX domain sockets the path is returned.
 func (a AddrSpec) Address() string {
+	if a.UnixSocket != "" {
+		return a.UnixSocket
+	}
 	if 0 != len(a.IP) {
-		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+		return net.JoinHostPort(a.ipString(), strconv.Itoa(a.Port))
 	}
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
@@ -71,15 +177,54 @@ type Request struct {
 	Version uint8
 	// Requested command
 	Command uint8
+	// ConnID uniquely identifies the connection within the Server
+	ConnID string
 	// AuthContext provided during negotiation
 	AuthContext *AuthContext
 	// AddrSpec of the the network that sent the request
 	RemoteAddr *AddrSpec
-	// AddrSpec of the desired destination
+	// Listener is the name of the listener the request came from,
+	// see Server.ServeListener
+	Listener string
+	// Priority of the request as returned by Config.PriorityFunc, set
+	// before the Limiter is consulted
+	Priority int
+	// AddrSpec of the desired destination. A requested FQDN is kept,
+	// its IP is filled in once resolved unless the Rewriter replaced it
 	DestAddr *AddrSpec
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
 	bufConn      io.Reader
+	// Context of the connection, as returned by a ContextAuthenticator
+	ctx context.Context
+	// Rules of the listener the request came from, if overridden
+	rules RuleSet
+	// Resolved addresses of realDestAddr to dial in order
+	candidates []net.IP
+	// Whether the tunnel to the client is compressed
+	compressed bool
+	// Durations of the phases handled so far
+	timings PhaseTimings
+	// Tags set by the resolver and dialer, see SetResolverTag
+	resolverTag string
+	dialerTag   string
+	// Outcome of the request, used for access logging
+	replyCode     uint8
+	replied       bool
+	bytesSent     int64
+	bytesReceived int64
+	// Arrival of the first relayed byte in Unix nanoseconds
+	firstByte int64
+}
+
+// RealDestAddr returns the destination actually used, after rewriting,
+// name resolution and redirects by the rules. DestAddr is returned
+// until the request is handled.
+func (r *Request) RealDestAddr() *AddrSpec {
+	if r.realDestAddr == nil {
+		return r.DestAddr
+	}
+	return r.realDestAddr
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -111,67 +256,426 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 	return request, nil
 }
 
-// handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn net.Conn) error {
-	ctx := context.Background()
-
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+// resolveDest fills in the IP of dest if it is a FQDN, replying
+// hostUnreachable if it can't be resolved. IP literals, requested as such
+// or as a FQDN, are dialed exactly and never passed to the Resolver. Only
+// a FQDN literal can carry an IPv6 zone. A nil conn, as for HealthCheck,
+// gets no reply.
+func (s *Server) resolveDest(ctx context.Context, conn net.Conn, req *Request, dest *AddrSpec, network string) (context.Context, error) {
+	if dest.IP != nil || dest.UnixSocket != "" {
+		return ctx, nil
+	}
+	if ip, zone := parseZonedIP(dest.FQDN); ip != nil {
+		dest.IP, dest.Zone = ip, zone
+	} else if dest.FQDN != "" {
+		resolveStart := time.Now()
+		ctx_, addrs, err := s.resolveCandidates(ctx, dest.FQDN, network)
+		req.timings.Resolution += time.Since(resolveStart)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
-				return fmt.Errorf("Failed to send reply: %v", err)
+			if conn != nil {
+				if err := s.reply(req, conn, hostUnreachable, nil); err != nil {
+					return ctx, fmt.Errorf("Failed to send reply: %v", err)
+				}
 			}
-			return fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
+			return ctx, fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
 		}
 		ctx = ctx_
-		dest.IP = addr
+		dest.IP = addrs[0]
+		req.candidates = addrs
 	}
+	return ctx, nil
+}
 
-	// Apply any address rewrites
+// checkReachable replies hostUnreachable if the IP of dest can't be
+// reached over the outbound network, a nil conn gets no reply
+func (s *Server) checkReachable(conn net.Conn, req *Request, dest *AddrSpec, network string) error {
+	if ip := dest.IP; ip != nil && !ipMatchesNetwork(ip, network) {
+		if conn != nil {
+			if err := s.reply(req, conn, hostUnreachable, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+		}
+		return fmt.Errorf("Destination %v is not reachable over %v", dest, network)
+	}
+	return nil
+}
+
+// handleRequest is used for request processing after authentication
+func (s *Server) handleRequest(req *Request, conn net.Conn) error {
+	network := s.outboundNetwork()
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, outboundNetworkKey{}, network)
+	ctx = context.WithValue(ctx, requestKey{}, req)
+	rules := s.ruleSet()
+	if req.rules != nil {
+		rules = req.rules
+	}
+
+	// A compressed CONNECT is handled as a CONNECT
+	if req.Command == compressedConnectCommand && s.config.EnableCompression {
+		req.Command = ConnectCommand
+		req.compressed = true
+	}
+
+	// Reject unknown and disabled commands before doing any work
+	switch req.Command {
+	case ConnectCommand, BindCommand, AssociateCommand:
+	default:
+		if err := s.reply(req, conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Unsupported command: %v", req.Command)
+	}
+	if !s.commandEnabled(req.Command) {
+		if err := s.reply(req, conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Command disabled: %v", req.Command)
+	}
+
+	// Resolve the address if we have a FQDN, unless the Rewriter replaces
+	// it anyway
 	req.realDestAddr = req.DestAddr
+	skipper, _ := s.config.Rewriter.(UnresolvedRewriter)
+	if skipper == nil || !skipper.SkipResolve(req) {
+		var err error
+		if ctx, err = s.resolveDest(ctx, conn, req, req.DestAddr, network); err != nil {
+			return err
+		}
+	}
+
+	// Apply any address rewrites, resolving a rewritten FQDN on a copy
+	// as rewriters may share it
 	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+		var dest *AddrSpec
+		ctx, dest = s.config.Rewriter.Rewrite(ctx, req)
+		if dest != nil && dest != req.DestAddr {
+			rewritten := *dest
+			req.realDestAddr = &rewritten
+			req.candidates = nil
+			var err error
+			if ctx, err = s.resolveDest(ctx, conn, req, req.realDestAddr, network); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Ensure the destination is reachable over the outbound network
+	if err := s.checkReachable(conn, req, req.realDestAddr, network); err != nil {
+		return err
 	}
 
 	// Switch on the command
 	switch req.Command {
 	case ConnectCommand:
-		return s.handleConnect(ctx, conn, req)
+		return s.handleConnect(ctx, conn, req, rules)
 	case BindCommand:
-		return s.handleBind(ctx, conn, req)
+		return s.handleBind(ctx, conn, req, rules)
 	case AssociateCommand:
-		return s.handleAssociate(ctx, conn, req)
+		return s.handleAssociate(ctx, conn, req, rules)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		if err := s.reply(req, conn, commandNotSupported, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Unsupported command: %v", req.Command)
 	}
 }
 
+// commandEnabled checks if a command is enabled in the config
+func (s *Server) commandEnabled(command uint8) bool {
+	switch command {
+	case ConnectCommand:
+		return !s.config.DisableConnect
+	case BindCommand:
+		return s.config.EnableBind
+	case AssociateCommand:
+		return s.config.EnableAssociate
+	}
+	return false
+}
+
+// deny reports a request denied by the rules and answers it according
+// to DenyBehavior
+func (s *Server) deny(req *Request, conn net.Conn) error {
+	atomic.AddInt64(&s.stats.denied, 1)
+	if s.config.OnDenied != nil {
+		host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		s.config.OnDenied(DeniedInfo{
+			ConnID:       req.ConnID,
+			Username:     req.AuthContext.username(),
+			IP:           host,
+			Port:         port,
+			Command:      req.Command,
+			DestAddr:     req.DestAddr,
+			RealDestAddr: req.RealDestAddr(),
+			Timestamp:    s.clock().Now(),
+		})
+	}
+	switch s.config.DenyBehavior {
+	case DenyDrop:
+		return nil
+	case DenyTarpit:
+		delay := s.config.TarpitDelay
+		if delay == 0 {
+			delay = defaultTarpitDelay
+		}
+		// Anything the client sends meanwhile is discarded, the request
+		// deadline is replaced by the delay
+		s.setDeadline(conn, time.Time{})
+		timer := s.clock().AfterFunc(delay, func() { conn.Close() })
+		defer timer.Stop()
+		io.Copy(io.Discard, conn)
+		return nil
+	}
+	return s.reply(req, conn, ruleFailure, nil)
+}
+
+// linger keeps conn open for the FailureLinger after a failure reply,
+// discarding what the client sends, so that closing doesn't reset the
+// connection before the client read the reply
+func (s *Server) linger(conn net.Conn) {
+	d := s.config.FailureLinger
+	if d == 0 {
+		d = defaultFailureLinger
+	}
+	if d < 0 {
+		return
+	}
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+	s.setDeadline(conn, time.Now().Add(d))
+	io.Copy(io.Discard, conn)
+}
+
+// connectTimeoutKey is the context key holding the connect timeout
+// of a request
+type connectTimeoutKey struct{}
+
+// WithConnectTimeout returns a context overriding Config.ConnectTimeout
+// for dialing the destination of the request, e.g. for a RuleSet or
+// Rewriter to give distant destinations more time. A custom Dial or
+// DialFunc gets it as the deadline of its context.
+func WithConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+// outboundNetworkKey is the context key holding the outbound network
+type outboundNetworkKey struct{}
+
+// requestKey is the context key holding the handled Request
+type requestKey struct{}
+
+// RequestFromContext returns the Request being handled, e.g. within a
+// custom Config.Dial, NameResolver or RuleSet, to get at the username,
+// requested destination or client address.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestKey{}).(*Request)
+	return req, ok
+}
+
+// SetResolverTag records which resolver handled the request of ctx, e.g.
+// "cache-hit" or "fallback", reported as FinishedConnInfo.ResolverTag. It
+// is meant to be called by a NameResolver, outside of a request it does
+// nothing.
+func SetResolverTag(ctx context.Context, tag string) {
+	if req, ok := RequestFromContext(ctx); ok {
+		req.resolverTag = tag
+	}
+}
+
+// SetDialerTag is the SetResolverTag of a custom Config.Dial or DialFunc,
+// reported as FinishedConnInfo.DialerTag
+func SetDialerTag(ctx context.Context, tag string) {
+	if req, ok := RequestFromContext(ctx); ok {
+		req.dialerTag = tag
+	}
+}
+
+// resolverTag returns the resolver tag of the request of ctx, if any
+func resolverTag(ctx context.Context) string {
+	if req, ok := RequestFromContext(ctx); ok {
+		return req.resolverTag
+	}
+	return ""
+}
+
+// dialFunc returns the function dialing the destination of req, from
+// Config.DialFunc, Config.Dial or a net.Dialer, along with its name for
+// error messages
+func (s *Server) dialFunc(req *Request, connectTimeout time.Duration) (func(ctx context.Context, net_, addr string) (net.Conn, error), string) {
+	if dialFunc := s.config.DialFunc; dialFunc != nil {
+		return func(ctx context.Context, net_, addr string) (net.Conn, error) {
+			return dialFunc(ctx, req, net_, addr)
+		}, "Config.DialFunc"
+	}
+	if dial := s.config.Dial; dial != nil {
+		return dial, "Config.Dial"
+	}
+	return func(ctx context.Context, net_, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: connectTimeout}
+		return d.DialContext(ctx, net_, addr)
+	}, "Config.Dial"
+}
+
+// outboundNetwork returns the network used for outbound connections
+func (s *Server) outboundNetwork() string {
+	if s.config.OutboundNetwork == "" {
+		return "tcp"
+	}
+	return s.config.OutboundNetwork
+}
+
+// ipMatchesNetwork checks if ip can be dialed over network
+func ipMatchesNetwork(ip net.IP, network string) bool {
+	switch network {
+	case "tcp4", "udp4", "ip4":
+		return ip.To4() != nil
+	case "tcp6", "udp6", "ip6":
+		return ip.To4() == nil && ip.To16() != nil
+	}
+	return true
+}
+
+// connStarted delivers the StartedConnInfo of req to StartedConnChan
+// unless nobody is receiving
+func (s *Server) connStarted(req *Request, clientConn net.Conn) {
+	host, port, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
+	select {
+	case s.StartedConnChan <- StartedConnInfo{
+		ConnID:       req.ConnID,
+		IP:           host,
+		Port:         port,
+		Username:     req.AuthContext.username(),
+		Command:      req.Command,
+		DestAddr:     req.DestAddr,
+		RealDestAddr: req.RealDestAddr(),
+		Timestamp:    s.clock().Now(),
+	}:
+	default:
+	}
+}
+
+// connFinisher returns the function reporting the end of the connection
+// of req, which starts now
+func (s *Server) connFinisher(req *Request, clientConn net.Conn) func(reason CloseReason, err error, sent, received int64) {
+	host, port, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
+	startTime := time.Now()
+	var authMethod uint8
+	if req.AuthContext != nil {
+		authMethod = req.AuthContext.Method
+	}
+	return func(reason CloseReason, err error, sent, received int64) {
+		var timeToFirstByte time.Duration
+		if req.firstByte != 0 {
+			timeToFirstByte = time.Unix(0, req.firstByte).Sub(startTime)
+		}
+		s.connFinished(FinishedConnInfo{
+			ConnID:          req.ConnID,
+			IP:              host,
+			Port:            port,
+			DestAddr:        req.DestAddr,
+			RealDestAddr:    req.RealDestAddr(),
+			Duration:        time.Since(startTime),
+			BytesSent:       sent,
+			BytesReceived:   received,
+			TimeToFirstByte: timeToFirstByte,
+			Timings:         req.timings,
+			ResolverTag:     req.resolverTag,
+			DialerTag:       req.dialerTag,
+			AuthMethod:      authMethod,
+			CloseReason:     reason,
+			Error:           err,
+		})
+	}
+}
+
 // handleConnect is used to handle a connect command
-func (s *Server) handleConnect(ctx context.Context, clientConn net.Conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(clientConn, ruleFailure, nil); err != nil {
+func (s *Server) handleConnect(ctx context.Context, clientConn net.Conn, req *Request, rules RuleSet) error {
+	finish := s.connFinisher(req, clientConn)
+
+	// Check if this is allowed, rules may redirect it
+	var redirect *AddrSpec
+	var allowed bool
+	if rrules, ok := rules.(RedirectRuleSet); ok {
+		ctx, redirect, allowed = rrules.AllowRedirect(ctx, req)
+	} else {
+		ctx, allowed = rules.Allow(ctx, req)
+	}
+	if allowed && redirect != nil {
+		// The redirect is resolved and checked like the requested
+		// destination, on a copy as rules may share it
+		dest := *redirect
+		network := s.outboundNetwork()
+		req.candidates = nil
+		ctx_, err := s.resolveDest(ctx, clientConn, req, &dest, network)
+		if err == nil {
+			err = s.checkReachable(clientConn, req, &dest, network)
+		}
+		if err != nil {
+			finish(CloseDialFailed, err, 0, 0)
+			return err
+		}
+		ctx = ctx_
+		req.realDestAddr = &dest
+	}
+	if !allowed {
+		finish(ClosePolicyDenied, nil, 0, 0)
+		if err := s.deny(req, clientConn); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return nil //fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
 	}
 
-	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.DialTimeout(net_, addr, s.config.ConnectTimeout)
+	// Apply any rewrites of the resolved address
+	if s.config.ResolvedRewriter != nil {
+		var dest *AddrSpec
+		ctx, dest = s.config.ResolvedRewriter.Rewrite(ctx, req)
+		if dest != nil && dest != req.realDestAddr {
+			req.realDestAddr = dest
+			req.candidates = nil
 		}
 	}
-	serverConn, err := dial(ctx, "tcp", req.realDestAddr.Address())
+
+	s.connStarted(req, clientConn)
+	ac := s.trackConn(req, clientConn)
+	defer s.untrackConn(ac)
+
+	// Attempt to connect, within the timeout of the request if set. The
+	// dial context gets it as its deadline, unless the context of the
+	// connection has an earlier one.
+	connectTimeout := s.config.ConnectTimeout
+	if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		connectTimeout = timeout
+	}
+	dialCtx := ctx
+	if connectTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+	}
+	dial, dialer := s.dialFunc(req, connectTimeout)
+	network := s.outboundNetwork()
+	if req.realDestAddr.UnixSocket != "" {
+		network = "unix"
+	}
+	dialStart := time.Now()
+	targetConn, err := dialCandidates(dialCtx, dial, network, req)
+	req.timings.Dial = time.Since(dialStart)
+	if err == nil && targetConn == nil {
+		// A misbehaving custom dialer, fail instead of using the nil conn
+		err = fmt.Errorf("%s returned neither a connection nor an error", dialer)
+		finish(CloseDialFailed, err, 0, 0)
+		if err := s.reply(req, clientConn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+	}
 	if err != nil {
+		finish(CloseDialFailed, err, 0, 0)
 		msg := err.Error()
 		resp := hostUnreachable
 		if strings.Contains(msg, "refused") {
@@ -179,59 +683,298 @@ func (s *Server) handleConnect(ctx context.Context, clientConn net.Conn, req *Re
 		} else if strings.Contains(msg, "network is unreachable") {
 			resp = networkUnreachable
 		}
-		if err := sendReply(clientConn, resp, nil); err != nil {
+		if err := s.reply(req, clientConn, resp, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
 	}
+	s.setSocketOptions(targetConn)
+	if s.config.WrapServerConn != nil {
+		targetConn = s.config.WrapServerConn(targetConn)
+	}
+	serverConn := NewMeteredConn(targetConn)
 	defer serverConn.Close()
+	s.setServerConn(ac, serverConn)
 
 	// Send success
-	local := serverConn.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(clientConn, successReply, &bind); err != nil {
+	bindAddr := serverConn.LocalAddr()
+	if s.config.ReplyRemoteAddr {
+		bindAddr = serverConn.RemoteAddr()
+	}
+	var bind *AddrSpec
+	if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok {
+		bind = &AddrSpec{IP: tcpAddr.IP, Port: tcpAddr.Port}
+	}
+	if ip := s.config.AdvertisedBindAddr; ip != nil && !s.config.ReplyRemoteAddr {
+		if bind == nil {
+			bind = &AddrSpec{}
+		}
+		bind.IP = ip
+	}
+	if err := s.reply(req, clientConn, successReply, bind); err != nil {
+		finish(CloseError, err, 0, 0)
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
+	// Forward data the client pipelined after the request. A compressed
+	// stream is read through the buffer instead.
+	if req.compressed {
+		var r io.Reader = clientConn
+		if req.bufConn != nil {
+			r = req.bufConn
+		}
+		clientConn = newFlateConn(clientConn, r)
+	} else if clientConn, err = flushBuffered(serverConn, clientConn, req.bufConn); err != nil {
+		finish(CloseError, err, serverConn.BytesWritten(), 0)
+		return fmt.Errorf("Failed to forward pipelined data: %v", err)
+	}
+
+	// The relay timeouts are deadlines, which wrapped connections might
+	// not support. Success clears the ConnectTimeout deadline.
+	s.setDeadline(clientConn, time.Time{})
+	s.setDeadline(serverConn, time.Time{})
+
 	// Start proxying
+	relayStart := time.Now()
+	result := relay(ctx, s.dumpConn(clientConn, req, "client->server"), s.dumpConn(serverConn, req, "server->client"), s.relayOptions())
+	req.timings.Relay = time.Since(relayStart)
+	if result.reason == CloseStalled {
+		atomic.AddInt64(&s.stats.stalled, 1)
+	}
+	// Close ends the relay from either side, whichever notices first
+	if s.isTerminating() {
+		result.reason, result.err = CloseShutdown, nil
+	}
+
+	req.bytesSent = serverConn.BytesWritten()
+	req.bytesReceived = serverConn.BytesRead()
+	req.firstByte = result.firstByte
+	finish(result.reason, result.err, req.bytesSent, req.bytesReceived)
+	return result.err
+}
+
+// relayOptions returns the RelayOptions of the Config
+func (s *Server) relayOptions() RelayOptions {
+	return RelayOptions{
+		ClientIdleTimeout:  s.idleTimeout(s.config.ClientIdleTimeout),
+		ServerIdleTimeout:  s.idleTimeout(s.config.ServerIdleTimeout),
+		IdleBothDirections: s.config.IdleBothDirections,
+		StallTimeout:       s.config.StallTimeout,
+		Logger:             s.config.Logger,
+	}
+}
+
+// RelayOptions configures Relay, the fields match those of Config
+type RelayOptions struct {
+	// ClientIdleTimeout and ServerIdleTimeout end the relay when the
+	// client or the server sent nothing for that long.
+	// Zero means no timeout.
+	ClientIdleTimeout time.Duration
+	ServerIdleTimeout time.Duration
+	// IdleBothDirections ends the relay on an idle timeout only if
+	// the other direction is idle as well
+	IdleBothDirections bool
+	// StallTimeout ends the relay when a write is blocked for that long
+	// because a peer stopped draining. Zero means no timeout.
+	StallTimeout time.Duration
+	// Logger receives the failures to set the deadlines of the timeouts,
+	// nil discards them
+	Logger *log.Logger
+}
+
+// Relay moves data between client and server like the Server does after
+// a CONNECT, e.g. for custom command handlers or benchmarks. It returns
+// once either side closed, a timeout of opts expired or ctx is done, and
+// closes both connections. An idle timeout is not an error, a stall is
+// reported as RelayStalled. sent is the number of bytes relayed to the
+// server and received the number relayed to the client.
+func Relay(ctx context.Context, client, server net.Conn, opts RelayOptions) (sent, received int64, err error) {
+	metered := NewMeteredConn(server)
+	result := relay(ctx, client, metered, opts)
+	return metered.BytesWritten(), metered.BytesRead(), result.err
+}
+
+// relayResult is the outcome of relay
+type relayResult struct {
+	reason CloseReason
+	err    error
+	// firstByte is the arrival of the first byte in Unix nanoseconds
+	firstByte int64
+}
+
+// relay proxies both directions between client and server until one ends
+func relay(ctx context.Context, client, server net.Conn, opts RelayOptions) relayResult {
 	errCh1, errCh2 := make(chan error, 1), make(chan error, 1)
 
-	go proxy(serverConn, clientConn, errCh1, s.config.IdleTimeout)
-	go proxy(clientConn, serverConn, errCh2, s.config.IdleTimeout)
+	state := &relayState{bothIdle: opts.IdleBothDirections, window: opts.ClientIdleTimeout, logger: opts.Logger}
+	if opts.ServerIdleTimeout > opts.ClientIdleTimeout {
+		state.window = opts.ServerIdleTimeout
+	}
+	go proxy(server, client, errCh1, opts.ClientIdleTimeout, opts.StallTimeout, state)
+	go proxy(client, server, errCh2, opts.ServerIdleTimeout, opts.StallTimeout, state)
 
-	host, port, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
-	defer func(startTime time.Time) {
-		select {
-		case s.FinishedConnChan <- FinishedConnInfo{
-			IP:       host,
-			Port:     port,
-			Duration: time.Since(startTime),
-		}:
-		default:
-		}
-	}(time.Now())
+	var result relayResult
 	select {
-	case e := <-errCh1:
-		return e
-	case e := <-errCh2:
-		return e
+	case result.err = <-errCh1:
+		result.reason = CloseClientEOF
+		server.Close()
+		client.Close()
+		<-errCh2
+	case result.err = <-errCh2:
+		result.reason = CloseServerEOF
+		server.Close()
+		client.Close()
+		<-errCh1
+	case <-ctx.Done():
+		server.Close()
+		client.Close()
+		<-errCh1
+		<-errCh2
+		if ctx.Err() == context.DeadlineExceeded {
+			result.reason = CloseMaxDuration
+		} else {
+			result.err = ctx.Err()
+		}
 	}
+	switch result.err {
+	case nil:
+	case errIdleTimeout:
+		result.reason = CloseIdleTimeout
+		result.err = nil
+	case RelayStalled:
+		result.reason = CloseStalled
+	default:
+		result.reason = CloseError
+	}
+	result.firstByte = atomic.LoadInt64(&state.firstByte)
+	return result
+}
+
+// flushBuffered forwards the bytes the client sent after its request,
+// which bufConn may already hold, and returns the connection to relay
+// from. The read ahead bytes of a *bufio.Reader are written to dst so
+// relaying continues from the raw client connection. Any other reader,
+// e.g. one given to NewRequest, is read through before the client
+// connection instead.
+func flushBuffered(dst io.Writer, client net.Conn, bufConn io.Reader) (net.Conn, error) {
+	if bufConn == nil || bufConn == io.Reader(client) {
+		return client, nil
+	}
+	if r, ok := bufConn.(*bufio.Reader); ok {
+		if r.Buffered() == 0 {
+			return client, nil
+		}
+		data, _ := r.Peek(r.Buffered())
+		if _, err := dst.Write(data); err != nil {
+			return nil, err
+		}
+		r.Discard(len(data))
+		return client, nil
+	}
+	return &readerConn{Conn: client, r: io.MultiReader(bufConn, client)}, nil
+}
+
+// readerConn is a net.Conn reading from r
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// dialCandidates dials the destination of req. When the AddressSortFunc
+// returned several addresses, they are tried in order until one connects.
+func dialCandidates(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, req *Request) (net.Conn, error) {
+	if len(req.candidates) < 2 {
+		return dial(ctx, network, req.realDestAddr.Address())
+	}
+	var err error
+	for _, ip := range req.candidates {
+		var conn net.Conn
+		addr := AddrSpec{IP: ip, Zone: req.realDestAddr.Zone, Port: req.realDestAddr.Port}.Address()
+		if conn, err = dial(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// relayState is shared by the two directions of a relay
+type relayState struct {
+	// firstByte is the arrival of the first byte in Unix nanoseconds
+	firstByte int64
+	// lastActive is when a direction last reported data in Unix nanoseconds
+	lastActive int64
+	// bothIdle makes a direction idle only if the other one is too
+	bothIdle bool
+	// window is the longest idle timeout of both directions. An active
+	// direction reports data at the end of every window, so each report
+	// stays valid for two windows to cover the time between reports.
+	window time.Duration
+	// logger receives the failures to set deadlines, nil discards them
+	logger *log.Logger
 }
 
 // proxy is used to suffle data from src to destination, and sends errors
-// down a dedicated channel
-func proxy(dst net.Conn, src net.Conn, errCh chan error, timeout time.Duration) {
-	src.SetReadDeadline(time.Now().Add(timeout))
-	dst.SetWriteDeadline(time.Now().Add(timeout))
-	for {
-		n, err := io.Copy(dst, src)
+// down a dedicated channel. A src without data for timeout is idle and
+// ends the relay with errIdleTimeout. With a stallTimeout, a write blocked
+// for longer because dst is not draining ends the relay with RelayStalled.
+// The optional state records the first byte and tracks idleness across
+// both directions.
+func proxy(dst net.Conn, src net.Conn, errCh chan error, timeout, stallTimeout time.Duration, state *relayState) {
+	var logger *log.Logger
+	if state != nil {
+		logger = state.logger
+	}
+	var w io.Writer = dst
+	var stall *stallWriter
+	if stallTimeout > 0 {
+		stall = &stallWriter{conn: dst, timeout: stallTimeout, logger: logger}
+		w = stall
+	}
+	resetDeadlines := func() {
+		if timeout <= 0 {
+			return
+		}
+		logDeadline(logger, "read deadline", src, src.SetReadDeadline(time.Now().Add(timeout)))
+		if stall == nil {
+			logDeadline(logger, "write deadline", dst, dst.SetWriteDeadline(time.Now().Add(timeout)))
+		}
+	}
+	resetDeadlines()
+	for first := state != nil; ; first = false {
+		var n int64
+		var err error
+		if first {
+			if n, err = copyFirst(w, src, &state.firstByte); err == nil {
+				atomic.StoreInt64(&state.lastActive, time.Now().UnixNano())
+				continue
+			}
+			if err == io.EOF {
+				err = nil
+			}
+		} else {
+			n, err = relayCopy(w, src)
+		}
+		if stall != nil && stall.stalled {
+			errCh <- RelayStalled
+			return
+		}
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			if n > 0 {
-				src.SetReadDeadline(time.Now().Add(timeout))
-				dst.SetWriteDeadline(time.Now().Add(timeout))
+				if state != nil {
+					atomic.StoreInt64(&state.lastActive, time.Now().UnixNano())
+				}
+				resetDeadlines()
+				continue
+			}
+			if state != nil && state.bothIdle && time.Since(time.Unix(0, atomic.LoadInt64(&state.lastActive))) < 2*state.window {
+				resetDeadlines()
 				continue
 			}
-			errCh <- nil
+			errCh <- errIdleTimeout
 			return
 		}
 		errCh <- err
@@ -239,11 +982,86 @@ func proxy(dst net.Conn, src net.Conn, errCh chan error, timeout time.Duration)
 	}
 }
 
-// handleBind is used to handle a connect command
-func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request) error {
+// idleTimeout returns the idle timeout of a direction, which defaults
+// to the IdleTimeout
+func (s *Server) idleTimeout(direction time.Duration) time.Duration {
+	if direction > 0 {
+		return direction
+	}
+	return s.config.IdleTimeout
+}
+
+// copyFirst relays the first chunk of data through a buffer to record
+// the time it arrived in firstByte, unless the other direction already
+// did. Later chunks keep the zero-copy path of relayCopy.
+func copyFirst(dst io.Writer, src io.Reader, firstByte *int64) (int64, error) {
+	buf := relayBufferPool.Get().(*[]byte)
+	defer relayBufferPool.Put(buf)
+	n, err := src.Read(*buf)
+	if n > 0 {
+		atomic.CompareAndSwapInt64(firstByte, 0, time.Now().UnixNano())
+		if written, err := dst.Write((*buf)[:n]); err != nil {
+			return int64(written), err
+		}
+	}
+	return int64(n), err
+}
+
+// stallWriter sets a write deadline before every write, so a peer that
+// stops draining is told apart from an idle one. It deliberately hides
+// io.ReaderFrom, which means relaying into it is not zero-copy.
+type stallWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	stalled bool
+	// logger receives the failures to set deadlines, nil discards them
+	logger *log.Logger
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	logDeadline(w.logger, "write deadline", w.conn, w.conn.SetWriteDeadline(time.Now().Add(w.timeout)))
+	n, err := w.conn.Write(b)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		w.stalled = true
+	}
+	return n, err
+}
+
+// relayBufferSize is the size of the pooled buffers used by relayCopy
+const relayBufferSize = 32 * 1024
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// relayCopy copies from src to dst. Plain io.Copy is used whenever either
+// side can move data itself (e.g. *net.TCPConn or MeteredConn), so the
+// runtime can splice between sockets. Other connections fall back to a
+// pooled buffer.
+func relayCopy(dst io.Writer, src io.Reader) (int64, error) {
+	_, readerFrom := dst.(io.ReaderFrom)
+	_, writerTo := src.(io.WriterTo)
+	if readerFrom || writerTo {
+		return io.Copy(dst, src)
+	}
+	buf := relayBufferPool.Get().(*[]byte)
+	defer relayBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// handleBind is used to handle a bind command. The first reply carries
+// the address the application server should connect to, the second one
+// where the accepted connection came from, then it is relayed.
+func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request, rules RuleSet) error {
+	finish := s.connFinisher(req, conn)
+
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	if ctx_, ok := rules.Allow(ctx, req); !ok {
+		finish(ClosePolicyDenied, nil, 0, 0)
+		if err := s.deny(req, conn); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
@@ -251,30 +1069,189 @@ func (s *Server) handleBind(ctx context.Context, conn net.Conn, req *Request) er
 		ctx = ctx_
 	}
 
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	s.connStarted(req, conn)
+	ac := s.trackConn(req, conn)
+	defer s.untrackConn(ac)
+
+	// Listen for the connection of the application server on the
+	// advertised address
+	bindIP := s.bindIP(conn)
+	host := ""
+	if bindIP != nil {
+		host = bindIP.String()
+	}
+	l, err := net.Listen(s.outboundNetwork(), net.JoinHostPort(host, "0"))
+	if err != nil {
+		finish(CloseError, err, 0, 0)
+		if err := s.reply(req, conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to listen for bind: %v", err)
+	}
+	defer l.Close()
+
+	local := l.Addr().(*net.TCPAddr)
+	if err := s.reply(req, conn, successReply, &AddrSpec{IP: local.IP, Port: local.Port}); err != nil {
+		finish(CloseError, err, 0, 0)
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
-	return nil
-}
 
-// handleAssociate is used to handle a connect command
-func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	// Wait for the inbound connection within the ConnectTimeout, until
+	// the connection context is done, e.g. after MaxConnDuration, or the
+	// client hangs up, which includes Close and Shutdown closing it
+	if timeout := s.config.ConnectTimeout; timeout > 0 {
+		if tl, ok := l.(*net.TCPListener); ok {
+			if err := tl.SetDeadline(time.Now().Add(timeout)); err != nil {
+				s.config.Logger.Printf("[WARN] socks: Failed to set bind deadline (listener: %v): %v", l.Addr(), err)
+			}
+		}
+	}
+	watch := watchBindClient(ctx, conn, req, l)
+	var inbound net.Conn
+	for inbound == nil && err == nil {
+		var c net.Conn
+		if c, err = l.Accept(); err != nil {
+			break
+		}
+		if s.config.EnforceBindPeer && !bindPeerMatches(req.RealDestAddr(), remoteAddrSpec(c)) {
+			s.config.Logger.Printf("[WARN] socks: Dropped bind connection from %v, expected %v", c.RemoteAddr(), req.RealDestAddr())
+			c.Close()
+			continue
+		}
+		inbound = c
+	}
+	l.Close()
+	conn, clientErr := watch.stop()
+	if inbound == nil {
+		switch {
+		case s.isTerminating():
+			finish(CloseShutdown, nil, 0, 0)
+			return nil
+		case clientErr != nil:
+			finish(CloseClientEOF, clientErr, 0, 0)
+			return fmt.Errorf("Client left while waiting for the bind connection: %v", clientErr)
+		case ctx.Err() == context.DeadlineExceeded:
+			finish(CloseMaxDuration, nil, 0, 0)
+			err = ctx.Err()
+		default:
+			finish(CloseError, err, 0, 0)
+		}
+		if err := s.reply(req, conn, serverFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
+		return fmt.Errorf("Failed to accept bind connection: %v", err)
 	}
+	peer := remoteAddrSpec(inbound)
 
-	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	s.setSocketOptions(inbound)
+	if s.config.WrapServerConn != nil {
+		inbound = s.config.WrapServerConn(inbound)
+	}
+	serverConn := NewMeteredConn(inbound)
+	defer serverConn.Close()
+	s.setServerConn(ac, serverConn)
+
+	// The second reply tells where the inbound connection came from
+	if err := s.reply(req, conn, successReply, peer); err != nil {
+		finish(CloseError, err, 0, 0)
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
-	return nil
+	conn, err = flushBuffered(serverConn, conn, req.bufConn)
+	if err != nil {
+		finish(CloseError, err, serverConn.BytesWritten(), 0)
+		return fmt.Errorf("Failed to forward pipelined data: %v", err)
+	}
+
+	s.setDeadline(conn, time.Time{})
+	relayStart := time.Now()
+	result := relay(ctx, conn, serverConn, s.relayOptions())
+	req.timings.Relay = time.Since(relayStart)
+	if result.reason == CloseStalled {
+		atomic.AddInt64(&s.stats.stalled, 1)
+	}
+	if s.isTerminating() {
+		result.reason, result.err = CloseShutdown, nil
+	}
+	req.bytesSent = serverConn.BytesWritten()
+	req.bytesReceived = serverConn.BytesRead()
+	req.firstByte = result.firstByte
+	finish(result.reason, result.err, req.bytesSent, req.bytesReceived)
+	return result.err
+}
+
+// bindWatch closes the listener of a BIND when its connection context is
+// done or its client hangs up while waiting for the inbound connection.
+// The client is read ahead through a buffer so the data it sends while
+// waiting is still relayed.
+type bindWatch struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	done   chan struct{}
+	peeked chan struct{}
+	err    error
+}
+
+// watchBindClient starts watching the client conn of req, which may have
+// its bufConn replaced
+func watchBindClient(ctx context.Context, conn net.Conn, req *Request, l net.Listener) *bindWatch {
+	w := &bindWatch{conn: conn, done: make(chan struct{}), peeked: make(chan struct{})}
+	if br, ok := req.bufConn.(*bufio.Reader); ok {
+		w.br = br
+	} else {
+		var r io.Reader = conn
+		if req.bufConn != nil && req.bufConn != io.Reader(conn) {
+			r = io.MultiReader(req.bufConn, conn)
+		}
+		w.br = bufio.NewReader(r)
+		w.conn = &readerConn{Conn: conn, r: w.br}
+		req.bufConn = nil
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-w.done:
+		}
+	}()
+	go func() {
+		defer close(w.peeked)
+		for {
+			if _, err := w.br.Peek(w.br.Buffered() + 1); err != nil {
+				// A full buffer or a deadline, e.g. set by stop, only
+				// ends the watch
+				if ne, ok := err.(net.Error); err != bufio.ErrBufferFull && !(ok && ne.Timeout()) {
+					w.err = err
+					l.Close()
+				}
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// stop ends the watch, it returns the connection to relay from and the
+// error the client hung up with, if any
+func (w *bindWatch) stop() (net.Conn, error) {
+	close(w.done)
+	// Interrupt the read ahead, the caller clears the deadline
+	if err := w.conn.SetReadDeadline(time.Unix(1, 0)); err != nil {
+		w.conn.Close()
+	}
+	<-w.peeked
+	return w.conn, w.err
+}
+
+// bindPeerMatches checks if the inbound connection of a BIND comes from
+// the requested address, an unspecified IP or zero port matches any
+func bindPeerMatches(expected, peer *AddrSpec) bool {
+	if peer == nil {
+		return false
+	}
+	if expected.IP != nil && !expected.IP.IsUnspecified() && !peer.IP.Equal(expected.IP) {
+		return false
+	}
+	return expected.Port == 0 || expected.Port == peer.Port
 }
 
 // readAddrSpec is used to read AddrSpec.
@@ -304,6 +1281,12 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 		}
 		d.IP = net.IP(addr)
 
+		// Normalize IPv4-mapped addresses (::ffff:a.b.c.d), so rules
+		// can't be bypassed by spelling an IPv4 destination as IPv6
+		if ip4 := d.IP.To4(); ip4 != nil {
+			d.IP = ip4
+		}
+
 	case fqdnAddress:
 		if _, err := r.Read(addrType); err != nil {
 			return nil, err
@@ -331,6 +1314,29 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg, err := formatMessage(resp, addr)
+	if err != nil {
+		return err
+	}
+
+	// Send the message, a misbehaving writer may return short writes
+	// without an error. Write deadlines of the conn still apply.
+	for len(msg) > 0 {
+		n, err := w.Write(msg)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// formatMessage formats a request or reply message, which only differ
+// in the meaning of the second byte (command or reply code)
+func formatMessage(code uint8, addr *AddrSpec) ([]byte, error) {
 	// Format the address
 	var addrType uint8
 	var addrBody []byte
@@ -357,22 +1363,19 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		return fmt.Errorf("Failed to format address: %v", addr)
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
 	}
 
 	// Format the message
 	msg := make([]byte, 6+len(addrBody))
 	msg[0] = socks5Version
-	msg[1] = resp
+	msg[1] = code
 	msg[2] = 0 // Reserved
 	msg[3] = addrType
 	copy(msg[4:], addrBody)
 	msg[4+len(addrBody)] = byte(addrPort >> 8)
 	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
-
-	// Send the message
-	_, err := w.Write(msg)
-	return err
+	return msg, nil
 }
 
 type closeWriter interface {
@@ -3,50 +3,112 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
 	buf bytes.Buffer
 }
 
+func (m *MockConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
 func (m *MockConn) Write(b []byte) (int, error) {
 	return m.buf.Write(b)
 }
 
+func (m *MockConn) Close() error {
+	return nil
+}
+
+func (m *MockConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 1080}
+}
+
 func (m *MockConn) RemoteAddr() net.Addr {
 	return &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 65432}
 }
 
-func TestRequest_Connect(t *testing.T) {
-	// Create a local listener
+func (m *MockConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (m *MockConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (m *MockConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// pingPongListener accepts a single connection answering "ping" with
+// "pong". The outcome is sent on the returned channel, as the test can't
+// fail from the goroutine serving it.
+func pingPongListener(t *testing.T) (*net.TCPAddr, <-chan error) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	t.Cleanup(func() { l.Close() })
+	errCh := make(chan error, 1)
 	go func() {
-		conn, err := l.Accept()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		defer conn.Close()
-
-		buf := make([]byte, 4)
-		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
-		}
+		errCh <- func() error {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
 
-		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
-		}
-		conn.Write([]byte("pong"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
+				return err
+			}
+			if !bytes.Equal(buf, []byte("ping")) {
+				return fmt.Errorf("bad: %v", buf)
+			}
+			_, err = conn.Write([]byte("pong"))
+			return err
+		}()
 	}()
-	lAddr := l.Addr().(*net.TCPAddr)
+	return l.Addr().(*net.TCPAddr), errCh
+}
+
+// blockingConn is a MockConn whose reads block until it is closed, like
+// a client waiting for the answer of the destination
+type blockingConn struct {
+	MockConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{closed: make(chan struct{})}
+}
+
+func (c *blockingConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *blockingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestRequest_Connect(t *testing.T) {
+	// Create a local listener
+	lAddr, pongErr := pingPongListener(t)
 
 	// Make server
 	s := &Server{config: &Config{
@@ -66,8 +128,8 @@ func TestRequest_Connect(t *testing.T) {
 	// Send a ping
 	buf.Write([]byte("ping"))
 
-	// Handle the request
-	resp := &MockConn{}
+	// Handle the request, the ping is read from the request buffer
+	resp := newBlockingConn()
 	req, err := NewRequest(buf)
 	if err != nil {
 		t.Fatalf("err: %v", err)
@@ -96,32 +158,14 @@ func TestRequest_Connect(t *testing.T) {
 	if !bytes.Equal(out, expected) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
+	if err := <-pongErr; err != nil {
+		t.Fatalf("err: %v", err)
+	}
 }
 
 func TestRequest_Connect_RuleFail(t *testing.T) {
 	// Create a local listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	go func() {
-		conn, err := l.Accept()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		defer conn.Close()
-
-		buf := make([]byte, 4)
-		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
-		}
-
-		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
-		}
-		conn.Write([]byte("pong"))
-	}()
-	lAddr := l.Addr().(*net.TCPAddr)
+	lAddr, _ := pingPongListener(t)
 
 	// Make server
 	s := &Server{config: &Config{
@@ -148,7 +192,8 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := s.handleRequest(req, resp); !strings.Contains(err.Error(), "blocked by rules") {
+	// A denial is answered, it isn't an error of the server
+	if err := s.handleRequest(req, resp); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -167,3 +212,553 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	return client, server
+}
+
+// opaqueConn hides the io.ReaderFrom/io.WriterTo of the wrapped conn
+type opaqueConn struct {
+	net.Conn
+}
+
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) net.Conn) {
+	srcClient, srcServer := tcpPair(b)
+	dstClient, dstServer := tcpPair(b)
+	defer srcClient.Close()
+	defer srcServer.Close()
+	defer dstClient.Close()
+	defer dstServer.Close()
+
+	errCh := make(chan error, 1)
+	go proxy(wrap(dstClient), wrap(srcServer), errCh, time.Minute, 0, nil)
+
+	chunk := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			srcClient.Write(chunk)
+		}
+	}()
+	if _, err := io.CopyN(io.Discard, dstServer, int64(b.N*len(chunk))); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+}
+
+func BenchmarkRelay_Splice(b *testing.B) {
+	benchmarkRelay(b, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkRelay_Metered(b *testing.B) {
+	benchmarkRelay(b, func(c net.Conn) net.Conn { return NewMeteredConn(c) })
+}
+
+func BenchmarkRelay_Buffered(b *testing.B) {
+	benchmarkRelay(b, func(c net.Conn) net.Conn { return opaqueConn{c} })
+}
+
+func TestRequest_Connect_OutboundNetwork(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:           PermitAll(),
+		Resolver:        DNSResolver{},
+		OutboundNetwork: "tcp6",
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "tcp6") {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, hostUnreachable, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+// shortWriter accepts at most one byte per Write without an error
+type shortWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *shortWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return w.buf.Write(b[:1])
+}
+
+func TestSendReply_ShortWrites(t *testing.T) {
+	w := &shortWriter{}
+	addr := &AddrSpec{IP: net.ParseIP("::1"), Port: 1080}
+	if err := sendReply(w, successReply, addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []byte{5, 0, 0, ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 56}
+	if !bytes.Equal(w.buf.Bytes(), expected) {
+		t.Fatalf("bad: %v %v", w.buf.Bytes(), expected)
+	}
+}
+
+func TestRequest_DisabledCommands(t *testing.T) {
+	for _, tc := range []struct {
+		conf    *Config
+		command uint8
+	}{
+		{&Config{DisableConnect: true}, ConnectCommand},
+		{&Config{}, BindCommand},
+		{&Config{}, AssociateCommand},
+	} {
+		tc.conf.Rules = PermitAll()
+		tc.conf.Resolver = DNSResolver{}
+		tc.conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+		s := &Server{config: tc.conf}
+
+		buf := bytes.NewBuffer([]byte{5, tc.command, 0, 1, 127, 0, 0, 1, 0, 80})
+		resp := &MockConn{}
+		req, err := NewRequest(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "disabled") {
+			t.Fatalf("%v: err: %v", tc.command, err)
+		}
+
+		out := resp.buf.Bytes()
+		expected := []byte{5, commandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("%v: bad: %v %v", tc.command, out, expected)
+		}
+	}
+}
+
+func TestRequest_UnknownCommand(t *testing.T) {
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	// The destination is never resolved for an unknown command
+	buf := bytes.NewBuffer([]byte{5, 9, 0, 3, 7})
+	buf.Write([]byte("invalid"))
+	buf.Write([]byte{0, 80})
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err == nil || !strings.Contains(err.Error(), "Unsupported command") {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := resp.buf.Bytes()
+	expected := []byte{5, commandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestProxy_Stall(t *testing.T) {
+	srcClient, srcServer := net.Pipe()
+	dstServer, dstClient := net.Pipe()
+	defer srcClient.Close()
+	defer dstClient.Close()
+
+	errCh := make(chan error, 1)
+	go proxy(dstServer, srcServer, errCh, time.Minute, 50*time.Millisecond, nil)
+
+	// Nobody reads from dstClient, so the relayed write can't complete
+	go srcClient.Write([]byte("ping"))
+
+	select {
+	case err := <-errCh:
+		if err != RelayStalled {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stall not detected")
+	}
+}
+
+func TestProxy_IdleNotStalled(t *testing.T) {
+	srcClient, srcServer := net.Pipe()
+	dstServer, dstClient := net.Pipe()
+	defer srcClient.Close()
+	defer dstClient.Close()
+
+	errCh := make(chan error, 1)
+	go proxy(dstServer, srcServer, errCh, 50*time.Millisecond, 20*time.Millisecond, nil)
+
+	select {
+	case err := <-errCh:
+		if err != errIdleTimeout {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle timeout not hit")
+	}
+}
+
+// denyPrivate denies destinations in private networks
+type denyPrivate struct{}
+
+func (denyPrivate) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	_, private, _ := net.ParseCIDR("192.168.0.0/16")
+	ip := req.DestAddr.IP
+	return ctx, len(ip) != net.IPv4len || !private.Contains(ip)
+}
+
+func TestNewRequest_IPv4MappedIPv6(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{5, ConnectCommand, 0, ipv6Address})
+	buf.Write(net.ParseIP("::ffff:192.168.0.1").To16())
+	buf.Write([]byte{0, 80})
+
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(req.DestAddr.IP, []byte{192, 168, 0, 1}) {
+		t.Fatalf("bad: %v", []byte(req.DestAddr.IP))
+	}
+	if _, ok := (denyPrivate{}).Allow(context.Background(), req); ok {
+		t.Fatalf("mapped private address allowed")
+	}
+}
+
+func TestProxy_IdleBothDirections(t *testing.T) {
+	for _, bothIdle := range []bool{false, true} {
+		quietClient, quietServer := net.Pipe()
+		quietDst, quietDstClient := net.Pipe()
+		busyClient, busyServer := net.Pipe()
+		busyDst, busyDstClient := net.Pipe()
+		go io.Copy(io.Discard, busyDstClient)
+
+		state := &relayState{bothIdle: bothIdle, window: 50 * time.Millisecond}
+		quietErr, busyErr := make(chan error, 1), make(chan error, 1)
+		go proxy(quietDst, quietServer, quietErr, 50*time.Millisecond, 0, state)
+		go proxy(busyDst, busyServer, busyErr, 50*time.Millisecond, 0, state)
+
+		// Keep one direction busy for a while
+		stop := time.After(300 * time.Millisecond)
+	busy:
+		for {
+			select {
+			case err := <-quietErr:
+				if bothIdle {
+					t.Fatalf("quiet direction ended while the other was busy: %v", err)
+				}
+				break busy
+			case <-stop:
+				if !bothIdle {
+					t.Fatalf("quiet direction did not time out")
+				}
+				break busy
+			case <-time.After(10 * time.Millisecond):
+				busyClient.Write([]byte("x"))
+			}
+		}
+
+		if bothIdle {
+			select {
+			case err := <-quietErr:
+				if err != errIdleTimeout {
+					t.Fatalf("err: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("idle connection not ended")
+			}
+		}
+		for _, c := range []net.Conn{quietClient, quietDstClient, busyClient, busyDstClient} {
+			c.Close()
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	client, clientSide := net.Pipe()
+	serverSide, server := net.Pipe()
+	done := make(chan struct{})
+	var sent, received int64
+	var err error
+	go func() {
+		defer close(done)
+		sent, received, err = Relay(context.Background(), clientSide, serverSide, RelayOptions{})
+	}()
+
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+	server.Write([]byte("pong!"))
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong!" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("relay did not end")
+	}
+	if err != nil || sent != 4 || received != 5 {
+		t.Fatalf("bad: %v %v %v", sent, received, err)
+	}
+}
+
+func TestRelay_ContextDone(t *testing.T) {
+	client, clientSide := net.Pipe()
+	defer client.Close()
+	serverSide, server := net.Pipe()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Relay(ctx, clientSide, serverSide, RelayOptions{})
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("relay did not end")
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	srcClient, srcServer := tcpPair(b)
+	dstClient, dstServer := tcpPair(b)
+	defer srcClient.Close()
+	defer dstServer.Close()
+	go Relay(context.Background(), srcServer, dstClient, RelayOptions{})
+
+	chunk := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			srcClient.Write(chunk)
+		}
+	}()
+	if _, err := io.CopyN(io.Discard, dstServer, int64(b.N*len(chunk))); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+}
+
+func TestRequest_DenyBehavior(t *testing.T) {
+	dest := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for _, tc := range []struct {
+		behavior DenyBehavior
+		reply    bool
+		held     time.Duration
+	}{
+		{DenyReply, true, 0},
+		{DenyDrop, false, 0},
+		{DenyTarpit, false, 50 * time.Millisecond},
+	} {
+		serv, err := New(&Config{
+			Rules:        PermitNone(),
+			DenyBehavior: tc.behavior,
+			TarpitDelay:  50 * time.Millisecond,
+			Logger:       log.New(os.Stdout, "", log.LstdFlags),
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		client, server := net.Pipe()
+		go serv.ServeConn(server)
+		client.SetDeadline(time.Now().Add(time.Second))
+		req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, byte(dest.Port)}
+		if _, err := client.Write(req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		start := time.Now()
+		out, _ := io.ReadAll(client)
+		if replied := len(out) > 0; replied != tc.reply {
+			t.Fatalf("%v: bad: %v", tc.behavior, out)
+		}
+		if tc.reply && out[1] != ruleFailure {
+			t.Fatalf("%v: bad: %v", tc.behavior, out)
+		}
+		if held := time.Since(start); held < tc.held {
+			t.Fatalf("%v: closed after %v", tc.behavior, held)
+		}
+		client.Close()
+	}
+}
+
+func TestRequest_Connect_NilDialConn(t *testing.T) {
+	serv, err := New(&Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+	client.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 1}
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != serverFailure {
+		t.Fatalf("bad: %v", out)
+	}
+	if err := <-errCh; err == nil || !strings.Contains(err.Error(), "Config.Dial returned neither") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// forbiddenResolver fails the test if it is ever consulted
+type forbiddenResolver struct {
+	t *testing.T
+}
+
+func (r forbiddenResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.t.Errorf("resolver consulted for %v", name)
+	return ctx, nil, fmt.Errorf("unexpected resolution")
+}
+
+func TestRequest_Connect_IPLiteral(t *testing.T) {
+	dialed := make(chan string, 1)
+	serv, err := New(&Config{
+		Resolver: forbiddenResolver{t},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, fmt.Errorf("connection refused")
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		dest   *AddrSpec
+		expect string
+	}{
+		{&AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 80}, "192.0.2.1:80"},
+		{&AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 443}, "[2001:db8::1]:443"},
+		// A literal sent as a domain name is not resolved either
+		{&AddrSpec{FQDN: "192.0.2.2", Port: 80}, "192.0.2.2:80"},
+		{&AddrSpec{FQDN: "2001:db8::2", Port: 80}, "[2001:db8::2]:80"},
+		// The zone of a link-local literal is kept for dialing
+		{&AddrSpec{FQDN: "fe80::1%eth0", Port: 22}, "[fe80::1%eth0]:22"},
+	} {
+		if code := connectThrough(t, serv, tc.dest); code != connectionRefused {
+			t.Fatalf("%v: bad: %v", tc.dest, code)
+		}
+		if addr := <-dialed; addr != tc.expect {
+			t.Fatalf("bad: %v, expected %v", addr, tc.expect)
+		}
+	}
+}
+
+func TestAddrSpec_String(t *testing.T) {
+	for _, tc := range []struct {
+		addr   *AddrSpec
+		expect string
+	}{
+		{&AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 80}, "127.0.0.1:80"},
+		{&AddrSpec{IP: net.ParseIP("::1"), Port: 80}, "[::1]:80"},
+		{&AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 443}, "[2001:db8::1]:443"},
+		{&AddrSpec{FQDN: "example.com", IP: net.ParseIP("127.0.0.1"), Port: 80}, "example.com (127.0.0.1):80"},
+		{&AddrSpec{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 22}, "[fe80::1%eth0]:22"},
+		{&AddrSpec{UnixSocket: "/tmp/sock"}, "unix:/tmp/sock"},
+	} {
+		if s := tc.addr.String(); s != tc.expect {
+			t.Fatalf("bad: %v, expected %v", s, tc.expect)
+		}
+	}
+}
+
+func TestAddrSpec_Equal(t *testing.T) {
+	ip := &AddrSpec{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 80}
+	if !ip.Equal(&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80}) {
+		t.Fatalf("expected equal")
+	}
+	if ip.Equal(&AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 81}) || ip.Equal(nil) {
+		t.Fatalf("expected not equal")
+	}
+	name := &AddrSpec{FQDN: "example.com", Port: 80}
+	if !name.Equal(&AddrSpec{FQDN: "example.com", IP: net.IPv4(127, 0, 0, 1), Port: 80}) {
+		t.Fatalf("expected equal")
+	}
+	if name.Equal(ip) {
+		t.Fatalf("expected not equal")
+	}
+}
+
+func TestNewAddrSpec(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}
+	if a := NewAddrSpec(tcp); a.String() != "[::1]:80" || a.Network() != "tcp" {
+		t.Fatalf("bad: %v", a)
+	}
+	if a := NewAddrSpec(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}); a.String() != "127.0.0.1:53" {
+		t.Fatalf("bad: %v", a)
+	}
+	if a := NewAddrSpec(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}); a.Network() != "unix" || a.UnixSocket != "/tmp/sock" {
+		t.Fatalf("bad: %v", a)
+	}
+	if a := NewAddrSpec(NewAddrSpec(tcp)); !a.Equal(NewAddrSpec(tcp)) {
+		t.Fatalf("bad: %v", a)
+	}
+	zoned := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 22}
+	if a := NewAddrSpec(zoned); a.Zone != "eth0" || a.Address() != zoned.String() {
+		t.Fatalf("bad: %v", a)
+	}
+	if a := NewAddrSpec(NewAddrSpec(zoned)); !a.Equal(NewAddrSpec(zoned)) || a.Equal(NewAddrSpec(&net.TCPAddr{IP: zoned.IP, Port: 22})) {
+		t.Fatalf("bad: %v", a)
+	}
+	if client, _ := net.Pipe(); NewAddrSpec(client.RemoteAddr()) != nil {
+		t.Fatalf("expected nil for pipes")
+	}
+}
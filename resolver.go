@@ -1,7 +1,9 @@
 package socks5
 
 import (
+	"fmt"
 	"net"
+	"strings"
 
 	"golang.org/x/net/context"
 )
@@ -11,13 +13,180 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
-// DNSResolver uses the system DNS to resolve host names
-type DNSResolver struct{}
+// MultiResolver can be implemented by a NameResolver which is able to
+// return every address of a name. It is used with Config.AddressSortFunc.
+type MultiResolver interface {
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
+// resolveAll resolves every address of name if r is a MultiResolver
+// and falls back to the single address of Resolve otherwise
+func resolveAll(r NameResolver, ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if multi, ok := r.(MultiResolver); ok {
+		return multi.ResolveAll(ctx, name)
+	}
+	ctx, addr, err := r.Resolve(ctx, name)
+	if err != nil || addr == nil {
+		return ctx, nil, err
+	}
+	return ctx, []net.IP{addr}, nil
+}
+
+// DNSResolver uses the system DNS to resolve host names.
+// Only addresses of the server's OutboundNetwork family are returned.
+type DNSResolver struct {
+	// Resolver is used for lookups if set, e.g. to query a specific
+	// DNS server through its Dial. Defaults to the system resolver.
+	Resolver *net.Resolver
+}
+
+// NewDNSResolver creates a DNSResolver doing lookups with r
+func NewDNSResolver(r *net.Resolver) DNSResolver {
+	return DNSResolver{Resolver: r}
+}
+
+// ipNetwork returns the IP network matching the OutboundNetwork in ctx
+func ipNetwork(ctx context.Context) string {
+	switch ctx.Value(outboundNetworkKey{}) {
+	case "tcp4":
+		return "ip4"
+	case "tcp6":
+		return "ip6"
+	}
+	return "ip"
+}
 
 func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+	ctx, ips, err := d.ResolveAll(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	// Prefer IPv4 like net.ResolveIPAddr does
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ctx, ip, nil
+		}
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll returns every address of name in the order of the resolver.
+// The lookup is aborted when ctx is done.
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, ipNetwork(ctx), name)
+	if err != nil {
+		// Report a cancelled or timed out request as such
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctx, nil, ctxErr
+		}
+		return ctx, nil, err
+	}
+	return ctx, ips, nil
+}
+
+// ChainResolver tries each resolver in order until one of them returns
+// an address. The context deadline applies to the whole chain. The
+// resolver tag is set to the index of the resolver which succeeded,
+// followed by its own tag if any, e.g. "chain[1]" or "chain[0]:cache-hit".
+type ChainResolver []NameResolver
+
+// tagChain sets the resolver tag after the i'th resolver of a chain
+// succeeded
+func tagChain(ctx context.Context, i int) {
+	tag := fmt.Sprintf("chain[%d]", i)
+	if inner := resolverTag(ctx); inner != "" {
+		tag += ":" + inner
+	}
+	SetResolverTag(ctx, tag)
+}
+
+func (c ChainResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	var errs []string
+	for i, r := range c {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		SetResolverTag(ctx, "")
+		ctx_, addr, err := r.Resolve(ctx, name)
+		if err == nil && addr != nil {
+			tagChain(ctx_, i)
+			return ctx_, addr, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no address returned")
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return ctx, nil, fmt.Errorf("No resolvers configured for '%v'", name)
+	}
+	return ctx, nil, fmt.Errorf("All resolvers failed for '%v': %v", name, strings.Join(errs, "; "))
+}
+
+// ResolveAll returns the addresses of the first resolver returning any.
+// Addresses of different resolvers are never merged, so a resolver
+// earlier in the chain always takes precedence.
+func (c ChainResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	var errs []string
+	for i, r := range c {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		SetResolverTag(ctx, "")
+		ctx_, addrs, err := resolveAll(r, ctx, name)
+		if err == nil && len(addrs) > 0 {
+			tagChain(ctx_, i)
+			return ctx_, addrs, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no address returned")
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return ctx, nil, fmt.Errorf("No resolvers configured for '%v'", name)
+	}
+	return ctx, nil, fmt.Errorf("All resolvers failed for '%v': %v", name, strings.Join(errs, "; "))
+}
+
+// resolveCandidates resolves name to the addresses to dial, in order.
+// Without an AddressSortFunc this is the single address of Resolve.
+// Otherwise all addresses usable over network are passed through it.
+func (s *Server) resolveCandidates(ctx context.Context, name, network string) (context.Context, []net.IP, error) {
+	sortAddrs := s.config.AddressSortFunc
+	if sortAddrs == nil {
+		ctx, addr, err := s.resolve(ctx, name)
+		if err != nil {
+			return ctx, nil, err
+		}
+		return ctx, []net.IP{addr}, nil
+	}
+
+	ctx, addrs, err := s.resolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if len(addrs) == 0 {
+		return ctx, nil, fmt.Errorf("No address returned")
+	}
+	var usable []net.IP
+	for _, ip := range addrs {
+		if ipMatchesNetwork(ip, network) {
+			usable = append(usable, ip)
+		}
+	}
+	if len(usable) == 0 {
+		// Let the caller report the family mismatch
+		return ctx, addrs[:1], nil
+	}
+	if usable = sortAddrs(name, usable); len(usable) == 0 {
+		return ctx, nil, fmt.Errorf("No address left after sorting")
+	}
+	return ctx, usable, nil
 }
@@ -1,7 +1,12 @@
 package socks5
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -19,3 +24,197 @@ func TestDNSResolver(t *testing.T) {
 		t.Fatalf("expected loopback")
 	}
 }
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, fmt.Errorf("boom")
+}
+
+func TestChainResolver(t *testing.T) {
+	ctx := context.Background()
+	c := ChainResolver{failingResolver{}, staticResolver{net.IPv4(10, 0, 0, 1)}}
+
+	_, addr, err := c.Resolve(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if !addr.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestChainResolver_AllFail(t *testing.T) {
+	ctx := context.Background()
+	c := ChainResolver{failingResolver{}, failingResolver{}}
+
+	_, _, err := c.Resolve(ctx, "example.com")
+	if err == nil || strings.Count(err.Error(), "boom") != 2 {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestChainResolver_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := ChainResolver{staticResolver{net.IPv4(10, 0, 0, 1)}}
+
+	if _, _, err := c.Resolve(ctx, "example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDNSResolver_OutboundNetwork(t *testing.T) {
+	d := DNSResolver{}
+	ctx := context.WithValue(context.Background(), outboundNetworkKey{}, "tcp4")
+
+	_, addr, err := d.Resolve(ctx, "localhost")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if addr.To4() == nil {
+		t.Fatalf("expected IPv4: %v", addr)
+	}
+}
+
+func TestDNSResolver_Custom(t *testing.T) {
+	var dialed string
+	d := NewDNSResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = address
+			return nil, fmt.Errorf("no dns")
+		},
+	})
+	ctx := context.Background()
+
+	if _, _, err := d.Resolve(ctx, "does-not-exist.invalid"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if dialed == "" {
+		t.Fatalf("custom resolver not used")
+	}
+
+	// Literal addresses need no lookup
+	_, addr, err := d.Resolve(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !addr.IsLoopback() {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+// multiResolver returns all of its addresses
+type multiResolver []net.IP
+
+func (m multiResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, m[0], nil
+}
+
+func (m multiResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	return ctx, m, nil
+}
+
+func TestChainResolver_ResolveAll(t *testing.T) {
+	ctx := context.Background()
+	first := multiResolver{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	c := ChainResolver{failingResolver{}, first, staticResolver{net.IPv4(10, 0, 0, 3)}}
+
+	_, addrs, err := c.ResolveAll(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) != 2 || !addrs[1].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("bad: %v", addrs)
+	}
+}
+
+func TestAddressSortFunc(t *testing.T) {
+	echo := echoListener(t)
+	sorted := make(chan []net.IP, 1)
+	proxy := startServer(t, &Config{
+		// Nothing listens on 127.0.0.2, so the dial falls back to the echo
+		Resolver: multiResolver{echo.IP, net.IPv4(127, 0, 0, 2)},
+		AddressSortFunc: func(name string, addrs []net.IP) []net.IP {
+			order := []net.IP{addrs[1], addrs[0]}
+			sorted <- order
+			return order
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if order := <-sorted; !order[0].Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("bad: %v", order)
+	}
+}
+
+func TestDNSResolver_Cancel(t *testing.T) {
+	d := NewDNSResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// Never answer
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, _, err := d.Resolve(ctx, "does-not-exist.invalid")
+	if err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancellation took %v", elapsed)
+	}
+}
+
+// taggedResolver resolves every name to ip, setting its resolver tag
+type taggedResolver struct {
+	ip  net.IP
+	tag string
+}
+
+func (r taggedResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	SetResolverTag(ctx, r.tag)
+	return ctx, r.ip, nil
+}
+
+func TestSOCKS5_ResolverDialerTags(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		// The first resolver tags but fails, the tag is not kept
+		Resolver: ChainResolver{taggedResolver{nil, "stale"}, taggedResolver{echo.IP, "cache-hit"}},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			SetDialerTag(ctx, "direct")
+			return net.Dial(network, addr)
+		},
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	info := <-finished
+	if info.ResolverTag != "chain[1]:cache-hit" || info.DialerTag != "direct" {
+		t.Fatalf("bad: %q %q", info.ResolverTag, info.DialerTag)
+	}
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"golang.org/x/net/context"
+)
+
+// UnixSocketRewriter is an AddressRewriter which maps host names to
+// UNIX domain socket paths. Destinations not in the map are not rewritten.
+type UnixSocketRewriter map[string]string
+
+func (u UnixSocketRewriter) Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec) {
+	path, ok := u[request.DestAddr.FQDN]
+	if !ok {
+		return ctx, request.DestAddr
+	}
+	return ctx, &AddrSpec{FQDN: request.DestAddr.FQDN, Port: request.DestAddr.Port, UnixSocket: path}
+}
+
+func (u UnixSocketRewriter) SkipResolve(request *Request) bool {
+	_, ok := u[request.DestAddr.FQDN]
+	return ok
+}
+
+// UserRouteRewriter is an AddressRewriter sending each authenticated user
+// to a fixed destination whatever the client requested, e.g. for a jump
+// host. Users not in the map are not rewritten. It is also a RuleSet
+// permitting only the users in the map, so it can be used as both the
+// Rewriter and the Rules.
+type UserRouteRewriter map[string]*AddrSpec
+
+func (u UserRouteRewriter) Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec) {
+	route, ok := u[request.AuthContext.username()]
+	if !ok {
+		return ctx, request.DestAddr
+	}
+	return ctx, route
+}
+
+func (u UserRouteRewriter) SkipResolve(request *Request) bool {
+	_, ok := u[request.AuthContext.username()]
+	return ok
+}
+
+func (u UserRouteRewriter) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	_, ok := u[req.AuthContext.username()]
+	return ctx, ok
+}
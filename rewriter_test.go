@@ -0,0 +1,256 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestUnixSocketRewriter(t *testing.T) {
+	r := UnixSocketRewriter{"local.service": "/run/service.sock"}
+	ctx := context.Background()
+
+	_, addr := r.Rewrite(ctx, &Request{DestAddr: &AddrSpec{FQDN: "local.service", Port: 80}})
+	if addr.UnixSocket != "/run/service.sock" || addr.Address() != "/run/service.sock" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	dest := &AddrSpec{FQDN: "example.com", Port: 80}
+	if _, addr := r.Rewrite(ctx, &Request{DestAddr: dest}); addr != dest {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestRequest_Connect_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    DNSResolver{},
+		Rewriter:    UnixSocketRewriter{"local.service": path}, // not resolved
+		IdleTimeout: time.Second,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 13})
+	buf.Write([]byte("local.service"))
+	buf.Write([]byte{0, 80})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		s.handleRequest(req, server)
+		server.Close()
+	}()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	out := make([]byte, 10+4)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []byte{5, successReply, 0, 1, 0, 0, 0, 0, 0, 0, 'p', 'o', 'n', 'g'}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestUserRouteRewriter(t *testing.T) {
+	echo := echoListener(t)
+	routes := UserRouteRewriter{"foo": &AddrSpec{IP: echo.IP, Port: echo.Port}}
+	proxy := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar", "baz": "bar"},
+		Rewriter:    routes,
+		Rules:       routes,
+		Resolver:    forbiddenResolver{t},
+	})
+
+	// The requested destination is ignored
+	foo := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	for i := 0; i < 2; i++ {
+		conn, err := foo.Dial("tcp", "127.0.0.1:1")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+	}
+
+	// The requested name of a routed user is never resolved
+	foo.RemoteResolve = true
+	conn, err := foo.Dial("tcp", "unresolvable.invalid:80")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	// Users without a route reach nothing
+	baz := &Dialer{ProxyAddr: proxy, Username: "baz", Password: "bar"}
+	if _, err := baz.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected rule failure")
+	}
+}
+
+// stageRecorder records the destination seen at each stage of a request
+type stageRecorder struct {
+	stages []string
+	pinned *AddrSpec
+}
+
+func (r *stageRecorder) record(stage string, req *Request) {
+	r.stages = append(r.stages, stage+" "+req.RealDestAddr().String())
+}
+
+type preRewriter struct{ *stageRecorder }
+
+func (r preRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	r.record("rewrite", req)
+	return ctx, req.DestAddr
+}
+
+func (r *stageRecorder) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.record("rules", req)
+	return ctx, true
+}
+
+type postRewriter struct{ *stageRecorder }
+
+func (r postRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	r.record("resolved", req)
+	if r.pinned != nil {
+		return ctx, r.pinned
+	}
+	return ctx, req.RealDestAddr()
+}
+
+func TestResolvedRewriter(t *testing.T) {
+	rec := &stageRecorder{}
+	dialed := make(chan string, 1)
+	serv, err := New(&Config{
+		Rewriter:         preRewriter{rec},
+		Rules:            rec,
+		Resolver:         staticResolver{net.IPv4(10, 0, 0, 1)},
+		ResolvedRewriter: postRewriter{rec},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, fmt.Errorf("connection refused")
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The resolved address is dialed unless rewritten
+	dest := &AddrSpec{FQDN: "cdn.example", Port: 443}
+	if code := connectThrough(t, serv, dest); code != connectionRefused {
+		t.Fatalf("bad: %v", code)
+	}
+	if addr := <-dialed; addr != "10.0.0.1:443" {
+		t.Fatalf("bad: %v", addr)
+	}
+	expect := []string{
+		"rewrite cdn.example (10.0.0.1):443",
+		"rules cdn.example (10.0.0.1):443",
+		"resolved cdn.example (10.0.0.1):443",
+	}
+	if !reflect.DeepEqual(rec.stages, expect) {
+		t.Fatalf("bad: %v", rec.stages)
+	}
+
+	// Pinning to an edge IP after seeing the resolution
+	rec.pinned = &AddrSpec{FQDN: "cdn.example", IP: net.IPv4(192, 0, 2, 7), Port: 443}
+	if code := connectThrough(t, serv, dest); code != connectionRefused {
+		t.Fatalf("bad: %v", code)
+	}
+	if addr := <-dialed; addr != "192.0.2.7:443" {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// A nil address is no rewrite
+	serv.config.ResolvedRewriter = nilRewriter{}
+	if code := connectThrough(t, serv, dest); code != connectionRefused {
+		t.Fatalf("bad: %v", code)
+	}
+	if addr := <-dialed; addr != "10.0.0.1:443" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+type nilRewriter struct{}
+
+func (nilRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, nil
+}
+
+// sharedRewriter sends every request to the same AddrSpec
+type sharedRewriter struct{ dest *AddrSpec }
+
+func (r sharedRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	return ctx, r.dest
+}
+
+func TestRewriter_SharedDest(t *testing.T) {
+	backend := &AddrSpec{FQDN: "backend", Port: 80}
+	dialed := make(chan string, 1)
+	serv, err := New(&Config{
+		Rewriter: sharedRewriter{backend},
+		Resolver: staticResolver{net.IPv4(127, 0, 0, 1)},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, fmt.Errorf("connection refused")
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every request resolves the rewritten name, leaving it as is
+	for i := 0; i < 2; i++ {
+		dest := &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+		if code := connectThrough(t, serv, dest); code != connectionRefused {
+			t.Fatalf("bad: %v", code)
+		}
+		if addr := <-dialed; addr != "127.0.0.1:80" {
+			t.Fatalf("bad: %v", addr)
+		}
+		if backend.IP != nil {
+			t.Fatalf("shared destination was modified: %v", backend)
+		}
+	}
+}
@@ -4,11 +4,24 @@ import (
 	"golang.org/x/net/context"
 )
 
-// RuleSet is used to provide custom rules to allow or prohibit actions
+// RuleSet is used to provide custom rules to allow or prohibit actions.
+// Allow is consulted for every command, req.Command tells them apart.
+// For ASSOCIATE it is consulted once for the association, with DestAddr
+// the address the client announced, and then for the destination of
+// every datagram, with DestAddr set to it. Denied datagrams are dropped.
 type RuleSet interface {
 	Allow(ctx context.Context, req *Request) (context.Context, bool)
 }
 
+// RedirectRuleSet can be implemented by a RuleSet to redirect a CONNECT
+// instead of denying it, e.g. to send blocked domains to a sinkhole.
+// When implemented, AllowRedirect is used instead of Allow for CONNECT
+// requests. A non-nil dest replaces the destination which is dialed.
+type RedirectRuleSet interface {
+	RuleSet
+	AllowRedirect(ctx context.Context, req *Request) (_ context.Context, dest *AddrSpec, allowed bool)
+}
+
 // PermitAll returns a RuleSet which allows all types of connections
 func PermitAll() RuleSet {
 	return &PermitCommand{true, true, true}
@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"fmt"
+	"net"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -22,3 +24,57 @@ func TestPermitCommand(t *testing.T) {
 		t.Fatalf("do not expect associate")
 	}
 }
+
+// sinkholeRules redirects every CONNECT to sinkhole
+type sinkholeRules struct {
+	sinkhole *AddrSpec
+}
+
+func (r sinkholeRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, true
+}
+
+func (r sinkholeRules) AllowRedirect(ctx context.Context, req *Request) (context.Context, *AddrSpec, bool) {
+	return ctx, r.sinkhole, true
+}
+
+func TestRedirectRuleSet(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{
+		Rules:    sinkholeRules{&AddrSpec{FQDN: "sinkhole.test", Port: echo.Port}},
+		Resolver: staticResolver{echo.IP},
+	})
+
+	// Nothing listens on port 1, the connection only works if redirected
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", net.JoinHostPort("127.0.0.1", "1"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func TestRedirectRuleSet_Unreachable(t *testing.T) {
+	sinkhole := &AddrSpec{FQDN: "sinkhole.test", Port: 80}
+	serv, err := New(&Config{
+		Rules:           sinkholeRules{sinkhole},
+		Resolver:        staticResolver{net.IPv6loopback},
+		OutboundNetwork: "tcp4",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("connection refused")
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The redirect only resolves to an IPv6 address
+	dest := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if code := connectThrough(t, serv, dest); code != hostUnreachable {
+		t.Fatalf("bad: %v", code)
+	}
+	if sinkhole.IP != nil {
+		t.Fatalf("shared redirect was modified: %v", sinkhole)
+	}
+}
@@ -2,11 +2,18 @@ package socks5
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"golang.org/x/net/context"
@@ -23,44 +30,426 @@ type Config struct {
 	// For password-based auth use UserPassAuthenticator.
 	AuthMethods []Authenticator
 
+	// MaxAuthMethods rejects clients advertising more auth methods than
+	// this with NO ACCEPTABLE METHODS. Defaults to 255, allowing all.
+	MaxAuthMethods int
+
+	// MaxAuthRounds limits the rounds of the auth method, which bounds
+	// multi-step methods like GSSAPI. A round starts whenever the server
+	// writes after having read from the client, so selecting the method
+	// is the first one and the writes of one turn count once. The
+	// connection is closed when the auth method exceeds it, UserPassAuth
+	// takes 2. Counting wraps the reader and writer given to the
+	// Authenticator, so zero, the default, doesn't limit the rounds and
+	// leaves the negotiation to the HandshakeTimeout.
+	MaxAuthRounds int
+
 	// If provided, username/password authentication is enabled,
 	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
 	// and AUthMethods is nil, then "auth-less" mode is enabled.
+	// Use a ChainCredentialStore for users in several stores.
 	Credentials CredentialStore
 
 	// Resolver can be provided to do custom name resolution.
 	// Defaults to DNSResolver if not provided.
+	// Can be replaced at runtime with Server.SetResolver.
 	Resolver NameResolver
 
+	// AddressSortFunc can be provided to order the addresses of a domain
+	// before dialing, e.g. to prefer a subnet or drop a known-bad IP.
+	// Addresses are then tried in the returned order until one connects.
+	// All addresses are only known if the Resolver is a MultiResolver.
+	AddressSortFunc func(name string, addrs []net.IP) []net.IP
+
 	// Rules is provided to enable custom logic around permitting
 	// various commands. If not provided, PermitAll is used.
+	// Can be replaced at runtime with Server.SetRuleSet.
 	Rules RuleSet
 
+	// DenyBehavior controls how requests denied by the RuleSet are
+	// answered, see DenyReply, DenyDrop and DenyTarpit. Defaults to
+	// DenyReply, a "not allowed by ruleset" reply.
+	DenyBehavior DenyBehavior
+	// TarpitDelay is how long DenyTarpit holds denied connections,
+	// defaults to 10 seconds
+	TarpitDelay time.Duration
+
+	// DisableConnect, EnableBind and EnableAssociate switch commands on
+	// and off without a RuleSet. Disabled commands are answered with
+	// "command not supported". By default only CONNECT is enabled.
+	// BIND accepts one inbound connection within the ConnectTimeout.
+	// UDP ASSOCIATE does not reassemble fragments,
+	// datagrams with a non-zero FRAG field are dropped.
+	DisableConnect  bool
+	EnableBind      bool
+	EnableAssociate bool
+
+	// EnforceBindPeer only accepts the inbound connection of a BIND from
+	// the requested DST.ADDR and DST.PORT, unless unspecified. Others are
+	// dropped, so a third party can't hijack the bound port. Off by
+	// default since NATs may rewrite the source address.
+	EnforceBindPeer bool
+
+	// EnableCompression accepts CONNECTs from a Dialer with CompressPorts
+	// set, whose tunnel to this server is compressed, e.g. for proxy to
+	// proxy links over constrained networks. The data is relayed to the
+	// destination uncompressed. Rules see these requests as CONNECTs.
+	EnableCompression bool
+
 	// Rewriter can be used to transparently rewrite addresses.
-	// This is invoked before the RuleSet is invoked.
-	// Defaults to NoRewrite.
+	// This is invoked after name resolution and before the RuleSet, a
+	// rewritten FQDN is resolved in turn. See UnresolvedRewriter for
+	// destinations which must not be resolved.
+	// Optional, addresses are not rewritten if not provided.
 	Rewriter AddressRewriter
+	// ResolvedRewriter rewrites the destination of a CONNECT once it is
+	// resolved and permitted, e.g. to pin a host name to an edge IP after
+	// seeing what it resolved to. The Request passed has the resolved
+	// RealDestAddr, and the returned address is dialed as is, a nil one
+	// leaves it unchanged. Requests are handled in this order: Resolver,
+	// Rewriter, RuleSet, ResolvedRewriter, Dial. Names are resolved before
+	// the RuleSet, as they always were, so rules see the IP which is
+	// dialed and a name can't slip past rules on IPs.
+	// Optional, resolved addresses are not rewritten if not provided.
+	ResolvedRewriter AddressRewriter
 
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
 
+	// UDPAdvertiseIP is the address advertised to clients for the UDP
+	// ASSOCIATE relay when it differs from the address the relay listens
+	// on, e.g. the public IP of a server behind NAT. The relay then
+	// listens on BindIP, or all addresses if BindIP is not set, and the
+	// advertised port is the port it listens on. Optional, BindIP is
+	// advertised if not set.
+	UDPAdvertiseIP net.IP
+
+	// ProxyProtocolTrustedCIDRs enables the PROXY protocol (v1) for
+	// connections coming from these networks, e.g. a load balancer.
+	// The header is optional for trusted peers and never honored for
+	// others, so clients can't spoof their address.
+	ProxyProtocolTrustedCIDRs []string
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger *log.Logger
 
-	// Optional function for dialing out
+	// Optional function for dialing out. The network is OutboundNetwork,
+	// or "unix" when the destination was rewritten to a UNIX domain socket
+	// in which case addr is the socket path.
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
 
-	ConnLimit      int
+	// Optional function for dialing out per request, e.g. to pick an
+	// egress interface by username or destination. Takes precedence
+	// over Dial and gets the same network and addr.
+	DialFunc func(ctx context.Context, req *Request, network, addr string) (net.Conn, error)
+
+	// ReadBufferSize and WriteBufferSize set the socket receive and send
+	// buffers (SO_RCVBUF and SO_SNDBUF) of accepted and dialed TCP
+	// connections. Zero keeps the OS default.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableNagle turns Nagle's algorithm on for accepted and dialed TCP
+	// connections. Go disables it (TCP_NODELAY) by default, which keeps
+	// latency low for interactive traffic like SSH. Enabling it coalesces
+	// small writes, trading latency for throughput on bulk transfers.
+	EnableNagle bool
+
+	// WrapClientConn and WrapServerConn can be provided to wrap
+	// connections with middleware such as taps or counters. Client
+	// connections are wrapped before the handshake, server connections
+	// right after they are dialed, and all traffic is relayed through
+	// the wrapped connections.
+	WrapClientConn func(net.Conn) net.Conn
+	WrapServerConn func(net.Conn) net.Conn
+	// ListenerWrapper wraps the listeners created by Listen, and so by
+	// ListenAndServe and ListenAndServeContext, e.g. to rate limit or tag
+	// accepted connections. Listeners given to Serve or ServeListener are
+	// used as is, wrap them directly instead.
+	ListenerWrapper func(net.Listener) net.Listener
+
+	// ReplyRemoteAddr makes successful CONNECT replies report the address
+	// of the destination (e.g. the resolved IP of a domain) in BND.ADDR
+	// and BND.PORT. By default the local address of the outbound socket
+	// is reported, which is what RFC 1928 specifies.
+	ReplyRemoteAddr bool
+
+	// AdvertisedBindAddr replaces the IP of the outbound socket in
+	// successful CONNECT replies, e.g. with the public IP of a server
+	// behind NAT whose sockets bind to a private one. The port stays the
+	// one of the socket. Ignored with ReplyRemoteAddr.
+	AdvertisedBindAddr net.IP
+
+	// OutboundNetwork restricts outbound connections to an address family.
+	// Must be one of "tcp", "tcp4" or "tcp6", defaults to "tcp".
+	// Destinations without an address of the requested family are
+	// reported as unreachable.
+	OutboundNetwork string
+
+	// ConnLimit limits the number of connections relaying traffic.
+	// Defaults to 50000, a negative value means unlimited.
+	ConnLimit int
+	// HandshakeLimit limits the number of connections negotiating auth
+	// and reading the request, independently of ConnLimit, so slow
+	// handshakes can't starve established connections.
+	// Defaults to ConnLimit, a negative value means unlimited.
+	HandshakeLimit int
+
+	// MaxMemoryBytes refuses new connections when the estimated memory
+	// of the served connections, see Stats.EstimatedMemoryBytes, would
+	// exceed it. It is a coarse guard based on the relay and datagram
+	// buffers, not a measure of the heap. Zero means unlimited.
+	MaxMemoryBytes int64
+
+	// Limiter admits connections to relaying traffic in place of the
+	// ConnLimit semaphore, e.g. to give authenticated users priority.
+	// Optional, ConnLimit applies if not provided.
+	Limiter Limiter
+
+	// PriorityFunc returns the priority of a request, e.g. from its user
+	// or destination, set as Request.Priority for the Limiter to use.
+	// Optional, every request has priority 0 if not provided.
+	PriorityFunc func(*Request) int
+	// ReservedConnFraction is the fraction of ConnLimit, between 0 and 1,
+	// which only requests with a positive priority may use, so they are
+	// still admitted when other connections exhausted the rest. Ignored
+	// with a custom Limiter or an unlimited ConnLimit.
+	ReservedConnFraction float64
+
+	// MaxConnsPerUser limits the concurrent connections of each
+	// authenticated username, regardless of its client IPs. Zero means
+	// unlimited. Connections over the limit get a general failure reply.
+	MaxConnsPerUser int
+	// LimitAnonymousConns counts unauthenticated connections against
+	// MaxConnsPerUser in one shared bucket, instead of exempting them.
+	LimitAnonymousConns bool
+
+	// MaxUDPAssociations limits the concurrent UDP ASSOCIATE relays, each
+	// holding a socket, independently of ConnLimit. Zero means unlimited.
+	// Associations over the limit get a general failure reply.
+	MaxUDPAssociations int
+
+	// MaxNewConnsPerSec limits the rate of new connections, globally,
+	// per client IP and per authenticated username. Bursts of up to one
+	// second worth of connections are allowed. Zero means unlimited.
+	// Connections over the rate are closed and counted in
+	// Stats.RateLimited, over the per user rate after a general
+	// failure reply.
+	MaxNewConnsPerSec        float64
+	MaxNewConnsPerSecPerIP   float64
+	MaxNewConnsPerSecPerUser float64
+
 	IdleTimeout    time.Duration
 	ConnectTimeout time.Duration
+
+	// HandshakeTimeout bounds the time from accepting a connection to
+	// having read its request, including the version byte and auth, so
+	// clients connecting and sending nothing are dropped quickly. Zero
+	// leaves the handshake to the ConnectTimeout of Serve.
+	HandshakeTimeout time.Duration
+
+	// FailureLinger is how long a connection is kept open after a
+	// failure reply, the reply being followed by a FIN where supported,
+	// while whatever the client still sends is discarded. Closing with
+	// unread data would send a RST, which can make the client lose the
+	// reply. The connection is closed as soon as the client closes it.
+	// Defaults to 500 milliseconds, a negative value closes right away.
+	FailureLinger time.Duration
+
+	// MaxConnDuration limits the lifetime of a connection from its
+	// accept, after which its relay or association is ended. The context
+	// passed to the authenticators, Resolver, RuleSet, Dial and other
+	// hooks carries it as its deadline, Dial gets the earlier of it and
+	// the ConnectTimeout. With a Clock the context is ended by its timer
+	// and carries no deadline. Zero means unlimited.
+	MaxConnDuration time.Duration
+
+	// ShutdownGracePeriod is how long ListenAndServeContext lets
+	// connections drain once its context is done, see Shutdown.
+	// Defaults to 30 seconds.
+	ShutdownGracePeriod time.Duration
+
+	// ClientIdleTimeout and ServerIdleTimeout override the IdleTimeout
+	// of the client to server and server to client direction, for
+	// protocols which legitimately pause one direction for longer.
+	ClientIdleTimeout time.Duration
+	ServerIdleTimeout time.Duration
+	// IdleBothDirections only ends a connection once both directions
+	// were silent for their idle timeout, instead of either one.
+	IdleBothDirections bool
+
+	// StallTimeout closes a relay when a single write can't complete
+	// within it, i.e. there is data to move but the peer is not draining.
+	// Unlike IdleTimeout, this is logged as an error and counted in
+	// Stats.Stalled. Relaying with a StallTimeout is not zero-copy.
+	StallTimeout time.Duration
+
+	// UsernameTagParser can be provided to split a tag (e.g. a tenant)
+	// out of the authenticated username. The tag is stored in
+	// AuthContext.Tag and the username is replaced by realUser.
+	UsernameTagParser func(username string) (tag, realUser string)
+
+	// AccessLogFormat enables writing an access log line to the Logger
+	// for every handled request. It is a text/template executed with an
+	// AccessLogEntry, e.g. CommonLogFormat or CombinedLogFormat.
+	AccessLogFormat string
+
+	// OnConnFinished is called synchronously with every FinishedConnInfo,
+	// unlike FinishedConnChan it never drops events. It must not block
+	// for long as it delays closing the client connection.
+	OnConnFinished func(FinishedConnInfo)
+
+	// OnAcceptError is called synchronously with every error accepting
+	// connections, besides logging it, e.g. to alert on running out of
+	// file descriptors. It must not block for long as it delays accepting.
+	OnAcceptError func(AcceptErrorInfo)
+
+	// OnExhausted is called synchronously whenever a connection is refused
+	// because the HandshakeLimit, ConnLimit, Limiter or MaxMemoryBytes is
+	// exhausted, e.g. to learn when to raise the limits. Refusals are also
+	// counted in Stats.Exhausted.
+	OnExhausted func(ExhaustedInfo)
+	// ReplyOnExhausted sends a general failure reply to requests refused
+	// because the ConnLimit or Limiter is exhausted, instead of closing
+	// the connection, for clients to report the proxy is at capacity.
+	// Connections refused earlier, by the HandshakeLimit or the rate
+	// limits per IP, are still closed as no request was read to reply to.
+	ReplyOnExhausted bool
+
+	// OnDenied is called synchronously whenever the RuleSet denies a
+	// CONNECT, BIND or ASSOCIATE request, before the DenyBehavior answer,
+	// e.g. to feed access denied events to a SIEM apart from dial
+	// failures. Denials are also counted in Stats.Denied.
+	OnDenied func(DeniedInfo)
+
+	// Clock replaces the time package for the connection rate limits,
+	// log sampling, the TarpitDelay, MaxConnDuration and the timestamps
+	// of events, e.g. for deterministic tests. The IdleTimeout,
+	// StallTimeout, ConnectTimeout and HandshakeTimeout are socket
+	// deadlines and always use the real time, as do measured durations.
+	// Optional, defaults to the time package.
+	Clock Clock
+
+	// MaxLogsPerSec limits the messages logged per second for each kind
+	// of connection error, e.g. auth failures, so floods of them don't
+	// drown the log. The number of dropped messages is logged with the
+	// next message of the kind. Zero means unlimited.
+	MaxLogsPerSec int
+
+	// RedactUsernames replaces usernames written to the Logger with
+	// a short hash of the username. Passwords are never logged.
+	RedactUsernames bool
+
+	// DebugDumpBytes logs the first DebugDumpBytes relayed in each
+	// direction of a CONNECT in hex, at the [DEBUG] level, to diagnose
+	// protocol issues without a packet capture. Zero disables dumps.
+	DebugDumpBytes int
+
+	// FailureDestLabel counts the failure replies by destination in
+	// Stats().FailedReplies, e.g. to find the destinations behind a
+	// spike of "connection refused". Defaults to DestLabelNone.
+	FailureDestLabel DestLabel
+
+	// ConnCountChanBlocking guarantees that the latest connection count is
+	// eventually delivered to ConnCountChan. Intermediate values may be
+	// coalesced while nobody is reading. By default updates are dropped
+	// when there is no reader. After Close or Shutdown, delivery stops
+	// once the count of 0 was delivered.
+	ConnCountChanBlocking bool
 }
 
-// FinishedConnInfo contains information about finished connection
-type FinishedConnInfo struct {
+// StartedConnInfo contains information about a connection whose request
+// was authorized and is about to be dialed, or for a BIND listened for
+type StartedConnInfo struct {
+	ConnID   string
 	IP       string
 	Port     string
-	Duration time.Duration
+	Username string
+	Command  uint8
+	// DestAddr is the destination as requested, see Request.DestAddr
+	DestAddr *AddrSpec
+	// RealDestAddr is the destination actually dialed,
+	// see Request.RealDestAddr
+	RealDestAddr *AddrSpec
+	Timestamp    time.Time
+}
+
+// CloseReason tells why a connection ended
+type CloseReason string
+
+const (
+	// CloseClientEOF means the client closed the connection
+	CloseClientEOF CloseReason = "client-eof"
+	// CloseServerEOF means the destination closed the connection
+	CloseServerEOF CloseReason = "server-eof"
+	// CloseIdleTimeout means no data was relayed for IdleTimeout
+	CloseIdleTimeout CloseReason = "idle-timeout"
+	// CloseStalled means a peer stopped draining for StallTimeout
+	CloseStalled CloseReason = "stalled"
+	// CloseMaxDuration means the connection lived for MaxConnDuration
+	CloseMaxDuration CloseReason = "max-duration"
+	// ClosePolicyDenied means the request was denied by the rules
+	ClosePolicyDenied CloseReason = "policy-denied"
+	// CloseDialFailed means the destination could not be dialed
+	CloseDialFailed CloseReason = "dial-failed"
+	// CloseShutdown means Close, or Shutdown running out of time, ended
+	// the connection
+	CloseShutdown CloseReason = "shutdown"
+	// CloseError means relaying failed with an error no other reason
+	// covers, e.g. a connection reset. FinishedConnInfo.Error tells which.
+	CloseError CloseReason = "error"
+)
+
+// FinishedConnInfo contains information about finished connection.
+// Requests denied by the rules finish with ClosePolicyDenied without
+// a prior StartedConnInfo.
+type FinishedConnInfo struct {
+	// ConnID matches the ConnID of the corresponding StartedConnInfo
+	ConnID string
+	IP     string
+	Port   string
+	// DestAddr is the destination as requested, see Request.DestAddr
+	DestAddr *AddrSpec
+	// RealDestAddr is the destination actually dialed,
+	// see Request.RealDestAddr
+	RealDestAddr *AddrSpec
+	Duration     time.Duration
+	// BytesSent is the number of bytes relayed to the destination
+	BytesSent int64
+	// BytesReceived is the number of bytes relayed from the destination
+	BytesReceived int64
+	// TimeToFirstByte is the time from the request to the first byte
+	// relayed in either direction, zero if nothing was relayed
+	TimeToFirstByte time.Duration
+	// Timings are the durations of the phases of the connection
+	Timings PhaseTimings
+	// ResolverTag and DialerTag tell which resolver and dialer handled
+	// the connection, see SetResolverTag and SetDialerTag
+	ResolverTag string
+	DialerTag   string
+	// AuthMethod is the negotiated auth method, e.g. NoAuth or UserPassAuth
+	AuthMethod uint8
+	// CloseReason tells why the connection ended
+	CloseReason CloseReason
+	// Error is the error that ended the connection, if any
+	Error error
+}
+
+// PhaseTimings are the durations of the phases of a connection, zero for
+// phases which didn't happen, e.g. Resolution for an IP destination
+type PhaseTimings struct {
+	// Handshake is the time from accepting the connection to having
+	// read the request, including Auth
+	Handshake time.Duration
+	// Auth is the time the auth method took
+	Auth time.Duration
+	// Resolution is the time spent resolving the destination
+	Resolution time.Duration
+	// Dial is the time connecting to the destination took
+	Dial time.Duration
+	// Relay is the time data was relayed
+	Relay time.Duration
 }
 
 // AuthFailedInfo provides information about failed auth attempt
@@ -72,20 +461,115 @@ type AuthFailedInfo struct {
 	Error     error
 }
 
+// DenyBehavior is the answer to requests denied by the RuleSet
+type DenyBehavior int
+
+const (
+	// DenyReply sends a "not allowed by ruleset" reply and closes
+	DenyReply DenyBehavior = iota
+	// DenyDrop closes the connection without a reply, so scanners
+	// can't tell a denial apart from other failures
+	DenyDrop
+	// DenyTarpit holds the connection without a reply for TarpitDelay,
+	// or until the client gives up, before closing it to slow scanners
+	DenyTarpit
+)
+
+// defaultTarpitDelay is the TarpitDelay if not configured
+const defaultTarpitDelay = 10 * time.Second
+
+// defaultFailureLinger is the FailureLinger if not configured
+const defaultFailureLinger = 500 * time.Millisecond
+
+// defaultShutdownGracePeriod is the ShutdownGracePeriod if not configured
+const defaultShutdownGracePeriod = 30 * time.Second
+
+// shutdownPollInterval is how often Shutdown checks for drained connections
+const shutdownPollInterval = 10 * time.Millisecond
+
+// AcceptErrorInfo provides information about a failure to accept a
+// connection
+type AcceptErrorInfo struct {
+	// Listener is the name of the listener, see Server.ServeListener
+	Listener string
+	Error    error
+	// Temporary errors like EMFILE may go away, others point to a
+	// broken listener
+	Temporary bool
+	Timestamp time.Time
+}
+
+// ExhaustedInfo provides information about a connection refused by an
+// exhausted limit
+type ExhaustedInfo struct {
+	// Limit is "handshake" for the HandshakeLimit, "relay" for the
+	// ConnLimit or Limiter and "memory" for the MaxMemoryBytes
+	Limit string
+	// ConnCount is the number of connections served when refusing
+	ConnCount int64
+	Timestamp time.Time
+}
+
+// DeniedInfo provides information about a request denied by the RuleSet
+type DeniedInfo struct {
+	ConnID string
+	// Username is empty for unauthenticated requests
+	Username string
+	IP       string
+	Port     string
+	Command  uint8
+	// DestAddr is the requested destination, RealDestAddr the one the
+	// rules were given after rewriting and name resolution
+	DestAddr     *AddrSpec
+	RealDestAddr *AddrSpec
+	Timestamp    time.Time
+}
+
 // Server is reponsible for accepting connections and handling
 // the details of the SOCKS5 protocol
 type Server struct {
 	config             *Config
 	authMethods        map[uint8]Authenticator
+	rules              atomic.Value
+	resolver           atomic.Value
+	stats              serverStats
+	activeLock         sync.Mutex
+	active             map[string]*activeConn
+	connRate           *rateLimiter
+	ipRate             *rateLimiter
+	userRate           *rateLimiter
+	lifecycleLock      sync.Mutex
+	closed             bool
+	terminating        bool
+	refusing           int32
+	listeners          map[net.Listener]struct{}
+	conns              map[net.Conn]struct{}
+	userLock           sync.Mutex
+	userConns          map[string]int
+	proxyTrusted       []*net.IPNet
+	accessLog          *template.Template
+	logSampler         logSampler
+	handshakeSema      chan struct{}
 	sema               chan struct{}
+	reservedSema       chan struct{}
+	connCountUpdate    chan struct{}
+	connCountStop      chan struct{}
+	connCountStopOnce  sync.Once
+	connCountDone      chan struct{}
 	ConnCountChan      chan int64
 	ConnCount          int64
+	lastConnID         uint64
+	StartedConnChan    chan StartedConnInfo
 	FinishedConnChan   chan FinishedConnInfo
 	AuthFailedInfoChan chan AuthFailedInfo
 }
 
 // New creates a new Server and potentially returns an error
 func New(conf *Config) (*Server, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
 	// Ensure we have at least one authentication method enabled
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
@@ -95,6 +579,10 @@ func New(conf *Config) (*Server, error) {
 		}
 	}
 
+	if conf.MaxAuthMethods == 0 {
+		conf.MaxAuthMethods = 255
+	}
+
 	// Ensure we have a DNS resolver
 	if conf.Resolver == nil {
 		conf.Resolver = DNSResolver{}
@@ -110,17 +598,70 @@ func New(conf *Config) (*Server, error) {
 		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
 	}
 
+	switch conf.OutboundNetwork {
+	case "":
+		conf.OutboundNetwork = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported outbound network: %v", conf.OutboundNetwork)
+	}
+
 	if conf.ConnLimit == 0 {
 		conf.ConnLimit = 50000
 	}
+	if conf.HandshakeLimit == 0 {
+		conf.HandshakeLimit = conf.ConnLimit
+	}
+	proxyTrusted, err := parseTrustedCIDRs(conf.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	var accessLog *template.Template
+	if conf.AccessLogFormat != "" {
+		accessLog, err = template.New("access").Parse(conf.AccessLogFormat)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid access log format: %v", err)
+		}
+	}
+
+	reserved := 0
+	if conf.ConnLimit > 0 {
+		reserved = int(float64(conf.ConnLimit) * conf.ReservedConnFraction)
+	}
+
 	server := &Server{
 		config:             conf,
-		sema:               make(chan struct{}, conf.ConnLimit),
+		handshakeSema:      newSema(conf.HandshakeLimit),
+		sema:               newSema(conf.ConnLimit - reserved),
+		reservedSema:       newSema(reserved),
 		ConnCountChan:      make(chan int64),
+		StartedConnChan:    make(chan StartedConnInfo),
 		FinishedConnChan:   make(chan FinishedConnInfo),
 		AuthFailedInfoChan: make(chan AuthFailedInfo),
+		proxyTrusted:       proxyTrusted,
+		accessLog:          accessLog,
+		connRate:           newRateLimiter(conf.MaxNewConnsPerSec, conf.Clock),
+		ipRate:             newRateLimiter(conf.MaxNewConnsPerSecPerIP, conf.Clock),
+		userRate:           newRateLimiter(conf.MaxNewConnsPerSecPerUser, conf.Clock),
+	}
+
+	// Warn when BIND or ASSOCIATE would advertise an unusable address
+	advertises := conf.EnableBind || (conf.EnableAssociate && conf.UDPAdvertiseIP == nil)
+	if advertises && (conf.BindIP == nil || conf.BindIP.IsUnspecified()) {
+		conf.Logger.Printf("[WARN] socks: BindIP is not set, falling back to the local address of each client connection")
+	}
+
+	if conf.ConnCountChanBlocking {
+		server.connCountUpdate = make(chan struct{}, 1)
+		server.connCountStop = make(chan struct{})
+		server.connCountDone = make(chan struct{})
+		go server.deliverConnCount()
 	}
 
+	server.SetRuleSet(conf.Rules)
+	server.SetResolver(conf.Resolver)
+
 	server.authMethods = make(map[uint8]Authenticator)
 
 	for _, a := range conf.AuthMethods {
@@ -130,32 +671,232 @@ func New(conf *Config) (*Server, error) {
 	return server, nil
 }
 
+// validate rejects configurations that would only fail at runtime.
+// Zero values are left alone for New to fill in defaults.
+func (c *Config) validate() error {
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"IdleTimeout", c.IdleTimeout},
+		{"ConnectTimeout", c.ConnectTimeout},
+		{"StallTimeout", c.StallTimeout},
+		{"ClientIdleTimeout", c.ClientIdleTimeout},
+		{"ServerIdleTimeout", c.ServerIdleTimeout},
+		{"TarpitDelay", c.TarpitDelay},
+		{"HandshakeTimeout", c.HandshakeTimeout},
+		{"ShutdownGracePeriod", c.ShutdownGracePeriod},
+		{"MaxConnDuration", c.MaxConnDuration},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			return fmt.Errorf("Invalid %s: %v is negative", t.name, t.value)
+		}
+	}
+	if c.MaxAuthMethods < 0 {
+		return fmt.Errorf("Invalid MaxAuthMethods: %v is negative", c.MaxAuthMethods)
+	}
+	if c.MaxMemoryBytes < 0 {
+		return fmt.Errorf("Invalid MaxMemoryBytes: %v is negative", c.MaxMemoryBytes)
+	}
+	if c.MaxAuthRounds < 0 {
+		return fmt.Errorf("Invalid MaxAuthRounds: %v is negative", c.MaxAuthRounds)
+	}
+	if c.ReservedConnFraction < 0 || c.ReservedConnFraction > 1 {
+		return fmt.Errorf("Invalid ReservedConnFraction: %v is not between 0 and 1", c.ReservedConnFraction)
+	}
+	if c.BindIP != nil && !c.EnableBind && !c.EnableAssociate {
+		return fmt.Errorf("BindIP is set but neither BIND nor ASSOCIATE is enabled")
+	}
+	if c.UDPAdvertiseIP != nil && (!c.EnableAssociate || c.UDPAdvertiseIP.IsUnspecified()) {
+		return fmt.Errorf("Invalid UDPAdvertiseIP: %v requires ASSOCIATE and a specified address", c.UDPAdvertiseIP)
+	}
+	seen := make(map[uint8]bool)
+	for _, a := range c.AuthMethods {
+		if seen[a.GetCode()] {
+			return fmt.Errorf("Duplicate auth method: %v", a.GetCode())
+		}
+		seen[a.GetCode()] = true
+	}
+	return nil
+}
+
+// Listen creates a listener without serving on it. This allows binding
+// privileged ports before dropping privileges and then calling Serve.
+// The listener is wrapped by the ListenerWrapper if set.
+func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.ListenerWrapper != nil {
+		l = s.config.ListenerWrapper(l)
+	}
+	return l, nil
+}
+
+// ServeFromFD serves on a listener inherited as a file descriptor,
+// e.g. from systemd socket activation. The listener is a duplicate of
+// f, which may be closed once ServeFromFD returned an error.
+func (s *Server) ServeFromFD(f *os.File) error {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return fmt.Errorf("Failed to create listener from fd: %v", err)
+	}
+	s.Serve(l)
+	return nil
+}
+
 // ListenAndServe is used to create a listener and serve on it
 func (s *Server) ListenAndServe(network string, addresses []string) {
 	for _, addr := range addresses[1:] {
-		if l, err := net.Listen(network, addr); err != nil {
+		if l, err := s.Listen(network, addr); err != nil {
 			s.config.Logger.Println(err)
 		} else {
 			go s.Serve(l)
 		}
 	}
-	if l, err := net.Listen(network, addresses[0]); err != nil {
+	if l, err := s.Listen(network, addresses[0]); err != nil {
 		s.config.Logger.Println(err)
 	} else {
 		s.Serve(l)
 	}
 }
 
+// ListenAndServeContext listens on addr and serves until ctx is done,
+// then shuts the Server down, draining connections for at most the
+// ShutdownGracePeriod. It returns the error of Listen, or ctx.Err()
+// once the Server is shut down.
+func (s *Server) ListenAndServeContext(ctx context.Context, network, addr string) error {
+	l, err := s.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	go s.Serve(l)
+
+	<-ctx.Done()
+	grace := s.config.ShutdownGracePeriod
+	if grace == 0 {
+		grace = defaultShutdownGracePeriod
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	s.Shutdown(shutdownCtx)
+	return ctx.Err()
+}
+
+// ruleSetHolder and resolverHolder wrap the interface values stored in
+// atomic.Value, which requires a consistent concrete type
+type ruleSetHolder struct{ RuleSet }
+type resolverHolder struct{ NameResolver }
+
+// SetRuleSet atomically replaces the RuleSet used for new requests.
+// Requests already being handled keep the RuleSet they started with.
+// A nil RuleSet permits all, like an unset Config.Rules.
+func (s *Server) SetRuleSet(rules RuleSet) {
+	if rules == nil {
+		rules = PermitAll()
+	}
+	s.rules.Store(ruleSetHolder{rules})
+}
+
+// SetResolver atomically replaces the NameResolver used for new requests.
+// Requests already being handled keep the NameResolver they started with.
+// A nil NameResolver uses DNS, like an unset Config.Resolver.
+func (s *Server) SetResolver(resolver NameResolver) {
+	if resolver == nil {
+		resolver = DNSResolver{}
+	}
+	s.resolver.Store(resolverHolder{resolver})
+}
+
+// ruleSet returns the current RuleSet
+func (s *Server) ruleSet() RuleSet {
+	if h, ok := s.rules.Load().(ruleSetHolder); ok {
+		return h.RuleSet
+	}
+	return s.config.Rules
+}
+
+// nameResolver returns the current NameResolver
+func (s *Server) nameResolver() NameResolver {
+	if h, ok := s.resolver.Load().(resolverHolder); ok {
+		return h.NameResolver
+	}
+	return s.config.Resolver
+}
+
 // GetConnCount returns connection count
 func (s *Server) GetConnCount() int64 {
 	return atomic.LoadInt64(&s.ConnCount)
 }
 
+// notifyConnCount pushes the current conn count to ConnCountChan
+func (s *Server) notifyConnCount() {
+	if s.connCountUpdate == nil {
+		select {
+		case s.ConnCountChan <- s.GetConnCount():
+		default:
+		}
+		return
+	}
+	select {
+	case s.connCountUpdate <- struct{}{}:
+	default:
+		// An update is already pending and will pick up the latest count
+	}
+}
+
+// deliverConnCount blocks on ConnCountChan until every pending update
+// is delivered, always sending the latest count
+func (s *Server) deliverConnCount() {
+	defer close(s.connCountDone)
+	stop := s.connCountStop
+	for {
+		select {
+		case <-s.connCountUpdate:
+		case <-stop:
+			// Keep delivering the updates of the closing connections
+			stop = nil
+		}
+		count := s.GetConnCount()
+		s.ConnCountChan <- count
+		if stop == nil && count == 0 {
+			return
+		}
+	}
+}
+
+// stopConnCount ends deliverConnCount once the connections are gone
+func (s *Server) stopConnCount() {
+	s.connCountStopOnce.Do(func() {
+		if s.connCountStop != nil {
+			close(s.connCountStop)
+		}
+	})
+}
+
 // GetConnCountChan returns channel where every change in conn count is pushed to
 func (s *Server) GetConnCountChan() chan int64 {
 	return s.ConnCountChan
 }
 
+// GetStartedConnChan returns channel where every started conn info is pushed to
+func (s *Server) GetStartedConnChan() chan StartedConnInfo {
+	return s.StartedConnChan
+}
+
+// connFinished delivers info to FinishedConnChan and OnConnFinished
+func (s *Server) connFinished(info FinishedConnInfo) {
+	select {
+	case s.FinishedConnChan <- info:
+	default:
+	}
+	if s.config.OnConnFinished != nil {
+		s.config.OnConnFinished(info)
+	}
+}
+
 // GetFinishedConnChan returns channel where every finished conn info is pushed to
 func (s *Server) GetFinishedConnChan() chan FinishedConnInfo {
 	return s.FinishedConnChan
@@ -166,92 +907,664 @@ func (s *Server) GetAuthFailedInfoChan() chan AuthFailedInfo {
 	return s.AuthFailedInfoChan
 }
 
-// Serve is used to serve connections from a listener
+// Serve is used to serve connections from a listener. A listener whose
+// address is already served is refused with an error in the log.
 func (s *Server) Serve(l net.Listener) {
+	if err := s.serve(l, nil); err != nil {
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+	}
+}
+
+// serve accepts connections on l and serves them with the given
+// listener overrides, which may be nil. It only returns an error when
+// the address of l is already served.
+func (s *Server) serve(l net.Listener, lc *listenerConfig) error {
+	if ok, err := s.trackListener(l); err != nil {
+		return err
+	} else if !ok {
+		l.Close()
+		return nil
+	}
+	defer s.untrackListener(l)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			s.config.Logger.Printf("[ERR] socks: %v", err)
+			if s.config.OnAcceptError != nil {
+				info := AcceptErrorInfo{Error: err, Timestamp: s.clock().Now()}
+				if lc != nil {
+					info.Listener = lc.name
+				}
+				if netErr, ok := err.(net.Error); ok {
+					info.Temporary = netErr.Temporary()
+				}
+				s.config.OnAcceptError(info)
+			}
 		} else {
-			conn.SetDeadline(time.Now().Add(s.config.ConnectTimeout))
-			go s.ServeConn(conn)
+			if s.config.ConnectTimeout > 0 {
+				s.setDeadline(conn, time.Now().Add(s.config.ConnectTimeout))
+			}
+			go s.serveConn(conn, lc)
 		}
 	}
 }
 
+// Close stops all listeners served by Serve and terminates every
+// connection immediately, including those still negotiating, use
+// Shutdown to let them finish. It is idempotent and the Server can't be
+// used after it.
+func (s *Server) Close() error {
+	s.lifecycleLock.Lock()
+	s.closed = true
+	s.terminating = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = nil
+	s.conns = nil
+	s.lifecycleLock.Unlock()
+	s.stopConnCount()
+
+	var errs []string
+	for l := range listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+	s.activeLock.Lock()
+	active := make([]*activeConn, 0, len(s.active))
+	for _, ac := range s.active {
+		active = append(active, ac)
+	}
+	s.activeLock.Unlock()
+	for _, ac := range active {
+		s.CloseConnection(ac.info.ConnID)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to close listeners: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Shutdown stops all listeners served by Serve and waits for every
+// connection to finish, unlike Close which terminates them. When ctx is
+// done first the remaining connections are closed and ctx.Err() is
+// returned. The Server can't be used after it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleLock.Lock()
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.lifecycleLock.Unlock()
+	s.stopConnCount()
+
+	var errs []string
+	for l := range listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.servedCount() > 0 {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to close listeners: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// servedCount returns the number of connections being served
+func (s *Server) servedCount() int {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	return len(s.conns)
+}
+
+// SetAcceptingNewConnections switches accepting new connections on and
+// off, e.g. to drain the Server before maintenance. While off, new
+// connections are closed right away and established ones keep running,
+// so Stats().ConnCount falls to zero. New connections are accepted by
+// default.
+func (s *Server) SetAcceptingNewConnections(accept bool) {
+	var refusing int32
+	if !accept {
+		refusing = 1
+	}
+	atomic.StoreInt32(&s.refusing, refusing)
+}
+
+// isTerminating reports whether Close was called, which ends every
+// connection
+func (s *Server) isTerminating() bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	return s.terminating
+}
+
+// isClosed reports whether Close or Shutdown was called
+func (s *Server) isClosed() bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	return s.closed
+}
+
+// trackListener registers a listener to be closed by Close, it returns
+// false if the Server is already closed. Serving a listener twice, or
+// two listeners on the same address, is an error.
+func (s *Server) trackListener(l net.Listener) (bool, error) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if s.closed {
+		return false, nil
+	}
+	for other := range s.listeners {
+		if other == l || sameAddr(other.Addr(), l.Addr()) {
+			return false, fmt.Errorf("Listener address %v is already served", l.Addr())
+		}
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true, nil
+}
+
+// sameAddr checks if a and b are the same address of the same network
+func sameAddr(a, b net.Addr) bool {
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	delete(s.listeners, l)
+}
+
+// trackServed registers a connection served by ServeConn to be closed
+// by Close, it returns false if the Server is already closed
+func (s *Server) trackServed(conn net.Conn) bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackServed(conn net.Conn) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	delete(s.conns, conn)
+}
+
+// setDeadline sets the deadline of conn, logging when it fails, e.g.
+// because a wrapped connection doesn't support deadlines, so timeouts
+// which don't apply are not silently skipped
+func (s *Server) setDeadline(conn net.Conn, t time.Time) {
+	logDeadline(s.config.Logger, "deadline", conn, conn.SetDeadline(t))
+}
+
+// setReadDeadline is setDeadline for the read deadline only
+func (s *Server) setReadDeadline(conn net.Conn, t time.Time) {
+	logDeadline(s.config.Logger, "read deadline", conn, conn.SetReadDeadline(t))
+}
+
+// setWriteDeadline is setDeadline for the write deadline only
+func (s *Server) setWriteDeadline(conn net.Conn, t time.Time) {
+	logDeadline(s.config.Logger, "write deadline", conn, conn.SetWriteDeadline(t))
+}
+
+// logDeadline logs err, the failure to set a deadline of conn, if any.
+// A nil logger discards it.
+func logDeadline(logger *log.Logger, kind string, conn net.Conn, err error) {
+	if err != nil && logger != nil {
+		logger.Printf("[WARN] socks: Failed to set %s (remote: %v): %v", kind, conn.RemoteAddr(), err)
+	}
+}
+
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.serveConn(conn, nil)
+}
+
+// serveConn serves a connection accepted on a listener with the given
+// overrides, which may be nil
+func (s *Server) serveConn(conn net.Conn, lc *listenerConfig) error {
+	start := time.Now()
 	defer func() {
 		if r := recover(); r != nil {
 			s.config.Logger.Printf("[ERR] socks: Panic recovered: %v", r)
 		}
 	}()
+	s.setSocketOptions(conn)
+	if s.config.WrapClientConn != nil {
+		conn = s.config.WrapClientConn(conn)
+	}
 	defer conn.Close()
-	select {
-	case s.sema <- struct{}{}:
-	default:
-		err := fmt.Errorf("Failed to handle request: exhausted")
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+	if atomic.LoadInt32(&s.refusing) != 0 {
+		return fmt.Errorf("Server not accepting new connections")
+	}
+	if !s.trackServed(conn) {
+		return fmt.Errorf("Server closed")
+	}
+	defer s.untrackServed(conn)
+
+	// The context of everything done for the connection
+	connCtx := context.Background()
+	if d := s.config.MaxConnDuration; d > 0 {
+		var cancel context.CancelFunc
+		if s.config.Clock != nil {
+			connCtx, cancel = withClockTimeout(connCtx, s.config.Clock, d)
+		} else {
+			connCtx, cancel = context.WithTimeout(connCtx, d)
+		}
+		defer cancel()
+	}
+
+	if !s.connRate.allow("") {
+		return s.rateLimited(fmt.Errorf("Connection rate exceeded"))
+	}
+
+	// Every resource below is released by a defer registered right
+	// after it is acquired, so all return paths (and panics) balance
+	// the semaphores and ConnCount
+	if !acquireSema(s.handshakeSema) {
+		err := fmt.Errorf("Failed to handle handshake: exhausted")
+		s.logf("exhausted", "[ERR] socks: %v", err)
+		s.exhausted("handshake")
 		return err
 	}
+	handshaking := true
+	releaseHandshake := func() {
+		if handshaking {
+			handshaking = false
+			releaseSema(s.handshakeSema)
+		}
+	}
+	defer releaseHandshake()
 	defer func() {
-		<-s.sema
 		atomic.AddInt64(&s.ConnCount, -1)
-		select {
-		case s.ConnCountChan <- s.GetConnCount():
-		default:
-		}
+		s.notifyConnCount()
 	}()
 	atomic.AddInt64(&s.ConnCount, 1)
-	select {
-	case s.ConnCountChan <- s.GetConnCount():
-	default:
+	s.notifyConnCount()
+	if max := s.config.MaxMemoryBytes; max > 0 && s.estimatedMemory() > max {
+		err := fmt.Errorf("Failed to handle handshake: estimated memory over MaxMemoryBytes")
+		s.logf("exhausted", "[ERR] socks: %v", err)
+		s.exhausted("memory")
+		return err
 	}
 
+	if s.config.HandshakeTimeout > 0 {
+		s.setDeadline(conn, time.Now().Add(s.config.HandshakeTimeout))
+	}
 	bufConn := bufio.NewReader(conn)
 
+	// Take the client address from a trusted PROXY protocol header
+	conn, err := s.readProxyHeader(conn, bufConn)
+	if err != nil {
+		s.logf("proxy header", "[ERR] socks: %v", err)
+		return err
+	}
+
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); !s.ipRate.allow(host) {
+		return s.rateLimited(fmt.Errorf("Connection rate exceeded (client: %s)", host))
+	}
+
 	// Read the version byte
 	version := []byte{0}
 	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+		s.logf("handshake", "[ERR] socks: Failed to get version byte: %v", err)
 		return err
 	}
 
 	// Ensure we are compatible
 	if version[0] != socks5Version {
 		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		if proto := misdirectedProtocol(version[0], bufConn); proto != "" {
+			err = fmt.Errorf("Received what looks like %s on SOCKS port, is the client configured to use a SOCKS5 proxy?", proto)
+		}
+		s.logf("handshake", "[ERR] socks: %v", err)
 		return err
 	}
 
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authMethods := s.authMethods
+	if lc != nil && lc.authMethods != nil {
+		authMethods = lc.authMethods
+	}
+	authStart := time.Now()
+	ctx, authContext, err := s.authenticateWith(connCtx, conn, bufConn, authMethods)
+	authDuration := time.Since(authStart)
 	if err != nil {
 		err = fmt.Errorf("Failed to authenticate: %v", err)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		s.logf("auth", "[ERR] socks: %v", err)
 		return err
 	}
 
+	if parse := s.config.UsernameTagParser; parse != nil && authContext.username() != "" {
+		tag, user := parse(authContext.username())
+		authContext.Tag = tag
+		authContext.Payload["Username"] = user
+	}
+
 	request, err := NewRequest(bufConn)
 	if err != nil {
 		if err == unrecognizedAddrType {
-			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
+			if err := s.sendReply(conn, addrTypeNotSupported, nil); err != nil {
 				return fmt.Errorf("Failed to send reply: %v", err)
 			}
 		}
 		return fmt.Errorf("Failed to read destination address: %v", err)
 	}
+	if s.config.HandshakeTimeout > 0 {
+		// Replying and dialing are still bounded by the ConnectTimeout
+		var deadline time.Time
+		if s.config.ConnectTimeout > 0 {
+			deadline = time.Now().Add(s.config.ConnectTimeout)
+		}
+		s.setDeadline(conn, deadline)
+	}
+	request.ConnID = strconv.FormatUint(atomic.AddUint64(&s.lastConnID, 1), 10)
 	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	request.ctx = ctx
+	request.timings.Handshake = time.Since(start)
+	request.timings.Auth = authDuration
+	request.RemoteAddr = remoteAddrSpec(conn)
+	if lc != nil {
+		request.Listener = lc.name
+		request.rules = lc.rules
 	}
 
+	// Enforce the per user connection rate and limit
+	if user := authContext.username(); user != "" && !s.userRate.allow(user) {
+		s.reply(request, conn, serverFailure, nil)
+		return s.rateLimited(fmt.Errorf("Connection rate exceeded (user: %s)", s.logUsername(user)))
+	}
+	if !s.acquireUser(authContext.username()) {
+		err := fmt.Errorf("Failed to handle request: too many connections (user: %s)", s.logUsername(authContext.username()))
+		s.logf("limit", "[ERR] socks: %v", err)
+		s.reply(request, conn, serverFailure, nil)
+		return err
+	}
+	defer s.releaseUser(authContext.username())
+
+	// Move the connection from the handshake to the relay limit
+	releaseHandshake()
+	if s.config.PriorityFunc != nil {
+		request.Priority = s.config.PriorityFunc(request)
+	}
+	limiter := s.limiter()
+	if err := limiter.Acquire(context.WithValue(ctx, requestKey{}, request)); err != nil {
+		err = fmt.Errorf("Failed to handle request: %v", err)
+		s.logf("exhausted", "[ERR] socks: %v", err)
+		s.exhausted("relay")
+		if s.config.ReplyOnExhausted && s.reply(request, conn, serverFailure, nil) == nil {
+			s.linger(conn)
+		}
+		return err
+	}
+	defer limiter.Release()
+
 	// Process the client request
-	if err := s.handleRequest(request, conn); err != nil {
+	defer s.logAccess(request, start)
+	err = s.handleRequest(request, conn)
+	if request.replied && request.replyCode != successReply {
+		s.linger(conn)
+	}
+	if err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+		if request.Listener != "" {
+			err = fmt.Errorf("%v (listener: %s)", err, request.Listener)
+		}
+		if user := authContext.username(); user != "" {
+			s.logf("request", "[ERR] socks: %v (user: %s)", err, s.logUsername(user))
+		} else {
+			s.logf("request", "[ERR] socks: %v", err)
+		}
 		return err
 	}
 
 	return nil
 }
+
+// tlsRecordHandshake is the first byte of a TLS ClientHello
+const tlsRecordHandshake = 0x16
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}
+
+// misdirectedProtocol returns "HTTP" or "TLS" if the client started
+// with the given byte and what has been buffered in r is consistent
+// with that protocol, and "" otherwise
+func misdirectedProtocol(first byte, r *bufio.Reader) string {
+	if first == tlsRecordHandshake {
+		return "TLS"
+	}
+	rest, _ := r.Peek(r.Buffered())
+	start := append([]byte{first}, rest...)
+	for _, method := range httpMethods {
+		method += " "
+		n := len(start)
+		if n > len(method) {
+			n = len(method)
+		}
+		if string(start[:n]) == method[:n] {
+			return "HTTP"
+		}
+	}
+	return ""
+}
+
+// Limiter is used to admit connections to relaying traffic.
+// Acquire is called with a context holding the Request, whose Priority
+// is set, see RequestFromContext, and may block. Release is called once
+// for every successful Acquire, when the connection is done.
+type Limiter interface {
+	Acquire(ctx context.Context) error
+	Release()
+}
+
+// errExhausted is returned by the default Limiter when full
+var errExhausted = fmt.Errorf("exhausted")
+
+// semaLimiter is the default Limiter, enforcing ConnLimit. Requests
+// with a positive priority fall back to the reserved slots when the
+// others are exhausted. It admits a single connection and remembers
+// which semaphore it acquired.
+type semaLimiter struct {
+	sema     chan struct{}
+	reserved chan struct{}
+	acquired chan struct{}
+}
+
+func (l *semaLimiter) Acquire(ctx context.Context) error {
+	if acquireSema(l.sema) {
+		l.acquired = l.sema
+		return nil
+	}
+	if req, ok := RequestFromContext(ctx); ok && req.Priority > 0 && l.reserved != nil && acquireSema(l.reserved) {
+		l.acquired = l.reserved
+		return nil
+	}
+	return errExhausted
+}
+
+func (l *semaLimiter) Release() {
+	releaseSema(l.acquired)
+}
+
+// limiter returns the Limiter admitting a connection to relaying
+func (s *Server) limiter() Limiter {
+	if s.config.Limiter != nil {
+		return s.config.Limiter
+	}
+	return &semaLimiter{sema: s.sema, reserved: s.reservedSema}
+}
+
+// newSema creates a semaphore of the given size,
+// a nil semaphore is returned for a negative (unlimited) size
+func newSema(size int) chan struct{} {
+	if size < 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
+}
+
+// acquireSema acquires the semaphore without blocking
+func acquireSema(sema chan struct{}) bool {
+	if sema == nil {
+		return true
+	}
+	select {
+	case sema <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSema releases a previously acquired semaphore
+func releaseSema(sema chan struct{}) {
+	if sema != nil {
+		<-sema
+	}
+}
+
+// exhausted counts and reports a connection refused by a limit
+func (s *Server) exhausted(limit string) {
+	atomic.AddInt64(&s.stats.exhausted, 1)
+	if s.config.OnExhausted != nil {
+		s.config.OnExhausted(ExhaustedInfo{
+			Limit:     limit,
+			ConnCount: s.GetConnCount(),
+			Timestamp: s.clock().Now(),
+		})
+	}
+}
+
+// rateLimited logs and counts a connection rejected by a rate limit
+func (s *Server) rateLimited(err error) error {
+	atomic.AddInt64(&s.stats.rateLimited, 1)
+	s.logf("rate limit", "[ERR] socks: %v", err)
+	return err
+}
+
+// socketOptions is implemented by *net.TCPConn
+type socketOptions interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SetNoDelay(noDelay bool) error
+}
+
+// setSocketOptions applies ReadBufferSize, WriteBufferSize and
+// EnableNagle to conn
+func (s *Server) setSocketOptions(conn net.Conn) {
+	sock, ok := conn.(socketOptions)
+	if !ok {
+		return
+	}
+	if s.config.EnableNagle {
+		if err := sock.SetNoDelay(false); err != nil {
+			s.config.Logger.Printf("[WARN] socks: Failed to enable Nagle: %v", err)
+		}
+	}
+	if size := s.config.ReadBufferSize; size > 0 {
+		if err := sock.SetReadBuffer(size); err != nil {
+			s.config.Logger.Printf("[WARN] socks: Failed to set read buffer: %v", err)
+		}
+	}
+	if size := s.config.WriteBufferSize; size > 0 {
+		if err := sock.SetWriteBuffer(size); err != nil {
+			s.config.Logger.Printf("[WARN] socks: Failed to set write buffer: %v", err)
+		}
+	}
+}
+
+// limitsUser reports whether MaxConnsPerUser applies to user
+func (s *Server) limitsUser(user string) bool {
+	return s.config.MaxConnsPerUser > 0 && (user != "" || s.config.LimitAnonymousConns)
+}
+
+// acquireUser counts a connection of user against MaxConnsPerUser,
+// it returns false if the user is already at the limit
+func (s *Server) acquireUser(user string) bool {
+	if !s.limitsUser(user) {
+		return true
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	if s.userConns == nil {
+		s.userConns = make(map[string]int)
+	}
+	if s.userConns[user] >= s.config.MaxConnsPerUser {
+		return false
+	}
+	s.userConns[user]++
+	return true
+}
+
+// releaseUser releases a connection counted by acquireUser
+func (s *Server) releaseUser(user string) {
+	if !s.limitsUser(user) {
+		return
+	}
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	if s.userConns[user]--; s.userConns[user] <= 0 {
+		delete(s.userConns, user)
+	}
+}
+
+// logUsername returns the username as it should appear in logs
+func (s *Server) logUsername(user string) string {
+	if !s.config.RedactUsernames {
+		return user
+	}
+	return redact(user)
+}
+
+// redact returns a short hash of value which identifies it in logs and
+// stats without revealing it
+func redact(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// bindIP returns the address advertised in BIND and ASSOCIATE replies.
+// Without a usable BindIP the local address the client connected to is
+// used, which is reachable by the client unlike 0.0.0.0.
+func (s *Server) bindIP(conn net.Conn) net.IP {
+	if ip := s.config.BindIP; ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return local.IP
+	}
+	return nil
+}
+
+// remoteAddrSpec returns the AddrSpec of the remote end of a TCP
+// connection, or nil for other kinds of connections
+func remoteAddrSpec(conn net.Conn) *AddrSpec {
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	return nil
+}
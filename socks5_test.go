@@ -1,40 +1,26 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSOCKS5_Connect(t *testing.T) {
 	// Create a local listener
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	go func() {
-		conn, err := l.Accept()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-		defer conn.Close()
-
-		buf := make([]byte, 4)
-		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
-		}
-
-		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
-		}
-		conn.Write([]byte("pong"))
-	}()
-	lAddr := l.Addr().(*net.TCPAddr)
+	lAddr, pongErr := pingPongListener(t)
 
 	// Create a socks server
 	creds := StaticCredentials{
@@ -42,8 +28,10 @@ func TestSOCKS5_Connect(t *testing.T) {
 	}
 	cator := UserPassAuthenticator{Credentials: creds}
 	conf := &Config{
-		AuthMethods: []Authenticator{cator},
-		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		AuthMethods:    []Authenticator{cator},
+		ConnectTimeout: time.Second,
+		IdleTimeout:    time.Second,
+		Logger:         log.New(os.Stdout, "", log.LstdFlags),
 	}
 	serv, err := New(conf)
 	if err != nil {
@@ -51,11 +39,7 @@ func TestSOCKS5_Connect(t *testing.T) {
 	}
 
 	// Start listening
-	go func() {
-		if err := serv.ListenAndServe("tcp", "127.0.0.1:12365"); err != nil {
-			t.Fatalf("err: %v", err)
-		}
-	}()
+	go serv.ListenAndServe("tcp", []string{"127.0.0.1:12365"})
 	time.Sleep(10 * time.Millisecond)
 
 	// Get a local conn
@@ -75,9 +59,6 @@ func TestSOCKS5_Connect(t *testing.T) {
 	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
 	req.Write(port)
 
-	// Send a ping
-	req.Write([]byte("ping"))
-
 	// Send all the bytes
 	conn.Write(req.Bytes())
 
@@ -91,7 +72,6 @@ func TestSOCKS5_Connect(t *testing.T) {
 		1,
 		127, 0, 0, 1,
 		0, 0,
-		'p', 'o', 'n', 'g',
 	}
 	out := make([]byte, len(expected))
 
@@ -107,4 +87,1894 @@ func TestSOCKS5_Connect(t *testing.T) {
 	if !bytes.Equal(out, expected) {
 		t.Fatalf("bad: %v", out)
 	}
+
+	// Send a ping
+	conn.Write([]byte("ping"))
+	pong := make([]byte, 4)
+	if _, err := io.ReadFull(conn, pong); err != nil || string(pong) != "pong" {
+		t.Fatalf("bad: %q %v", pong, err)
+	}
+	if err := <-pongErr; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_SetRuleSet(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		Rules:  PermitNone(),
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{IP: lAddr.IP, Port: lAddr.Port}
+	if reply := connectThrough(t, serv, dest); reply != ruleFailure {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	serv.SetRuleSet(PermitAll())
+
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// Nil permits all, like an unset Config.Rules
+	serv.SetRuleSet(PermitNone())
+	serv.SetRuleSet(nil)
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+func TestSOCKS5_SetResolver(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{FQDN: "swapped.invalid", Port: lAddr.Port}
+	if reply := connectThrough(t, serv, dest); reply != hostUnreachable {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	serv.SetResolver(staticResolver{lAddr.IP})
+
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// Nil goes back to DNS, like an unset Config.Resolver
+	serv.SetResolver(nil)
+	if reply := connectThrough(t, serv, dest); reply != hostUnreachable {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+type staticResolver struct {
+	ip net.IP
+}
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r.ip, nil
+}
+
+// closingListener starts a listener which accepts and immediately
+// closes connections, and returns its address
+func closingListener(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// connectThrough performs a no-auth CONNECT to dest over a fresh
+// connection served by serv and returns the reply code
+func connectThrough(t *testing.T, serv *Server, dest *AddrSpec) uint8 {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, NoAuth})
+	req.Write([]byte{5, ConnectCommand, 0})
+	if dest.FQDN != "" {
+		req.Write([]byte{fqdnAddress, byte(len(dest.FQDN))})
+		req.Write([]byte(dest.FQDN))
+	} else if ip4 := dest.IP.To4(); ip4 != nil {
+		req.Write([]byte{ipv4Address})
+		req.Write(ip4)
+	} else {
+		req.Write([]byte{ipv6Address})
+		req.Write(dest.IP.To16())
+	}
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(dest.Port))
+	req.Write(port)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(req.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return out[3]
+}
+
+func TestSOCKS5_ConnCountChanBlocking(t *testing.T) {
+	serv, err := New(&Config{
+		ConnCountChanBlocking: true,
+		Logger:                log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	client.Close()
+	if err := serv.ServeConn(server); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Nobody was reading while the connection was served, but the
+	// final count must still be delivered
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case count := <-serv.GetConnCountChan():
+			if count == 0 {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("final conn count was not delivered")
+		}
+	}
+}
+
+func TestSOCKS5_ConnCountChanBlocking_Close(t *testing.T) {
+	serv, err := New(&Config{
+		ConnCountChanBlocking: true,
+		Logger:                log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A connection still negotiating when the server is closed
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	if count := <-serv.GetConnCountChan(); count != 1 {
+		t.Fatalf("bad: %v", count)
+	}
+	serv.Close()
+
+	// The delivery ends with the final count
+	timeout := time.After(time.Second)
+	var last int64 = -1
+	for {
+		select {
+		case last = <-serv.GetConnCountChan():
+			continue
+		case <-serv.connCountDone:
+		case <-timeout:
+			t.Fatalf("delivery did not stop, last count: %v", last)
+		}
+		break
+	}
+	if last != 0 {
+		t.Fatalf("bad final count: %v", last)
+	}
+}
+
+func TestSOCKS5_ListenThenServe(t *testing.T) {
+	serv, err := New(&Config{
+		ConnectTimeout: time.Second,
+		Logger:         log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l, err := serv.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{socks5Version, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_StartedConnChan(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		IdleTimeout: time.Second,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	started := make(chan StartedConnInfo, 1)
+	go func() {
+		started <- <-serv.GetStartedConnChan()
+	}()
+	finished := make(chan FinishedConnInfo, 1)
+	go func() {
+		finished <- <-serv.GetFinishedConnChan()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	dest := &AddrSpec{IP: lAddr.IP, Port: lAddr.Port}
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	select {
+	case info := <-started:
+		if info.ConnID == "" || info.Command != ConnectCommand || info.DestAddr.Port != lAddr.Port {
+			t.Fatalf("bad: %#v", info)
+		}
+		select {
+		case fin := <-finished:
+			if fin.ConnID != info.ConnID {
+				t.Fatalf("bad: %v %v", fin.ConnID, info.ConnID)
+			}
+			if fin.CloseReason != CloseServerEOF && fin.CloseReason != CloseClientEOF {
+				t.Fatalf("bad: %v", fin.CloseReason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no finished event")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no started event")
+	}
+}
+
+func TestSOCKS5_HandshakeLimit(t *testing.T) {
+	// The destination holds every connection open for a while
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				conn.Close()
+			}()
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+	dest := &AddrSpec{IP: lAddr.IP, Port: lAddr.Port}
+
+	serv, err := New(&Config{
+		ConnLimit:      2,
+		HandshakeLimit: 1,
+		IdleTimeout:    time.Second,
+		Logger:         log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Relaying connections don't hold the handshake slot
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+	if reply := connectThrough(t, serv, dest); reply != successReply {
+		t.Fatalf("bad: %v", reply)
+	}
+
+	// A client sending nothing holds the only handshake slot
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	time.Sleep(10 * time.Millisecond)
+
+	_, other := net.Pipe()
+	if err := serv.ServeConn(other); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_PasswordNeverLogged(t *testing.T) {
+	var logs bytes.Buffer
+	serv, err := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Logger:      log.New(&logs, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write([]byte{5, 1, UserPassAuth})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{1, 3, 'f', 'o', 'o', 6, 's', 'e', 'c', 'r', 'e', 't'})
+		io.ReadFull(client, make([]byte, 2))
+	}()
+	err = serv.ServeConn(server)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if strings.Contains(logs.String(), "secret") || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("password leaked: %v", logs.String())
+	}
+}
+
+func TestSOCKS5_RedactUsernames(t *testing.T) {
+	var logs bytes.Buffer
+	serv, err := New(&Config{
+		Credentials:     StaticCredentials{"foo": "bar"},
+		Rules:           PermitNone(),
+		RedactUsernames: true,
+		Logger:          log.New(&logs, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write([]byte{5, 1, UserPassAuth})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte{5, BindCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 80})
+		io.ReadFull(client, make([]byte, 10))
+	}()
+	if err := serv.ServeConn(server); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, serv.logUsername("foo")) || strings.Contains(out, "user: foo") {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_UnlimitedConnLimit(t *testing.T) {
+	serv, err := New(&Config{
+		ConnLimit: -1,
+		Logger:    log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if serv.sema != nil || serv.handshakeSema != nil {
+		t.Fatalf("expected no semaphores")
+	}
+
+	// Many concurrent handshakes are all admitted
+	for i := 0; i < 10; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serv.ServeConn(server)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := serv.GetConnCount(); n != 10 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+type panicAuthenticator struct{}
+
+func (panicAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (panicAuthenticator) Authenticate(reader io.Reader, writer net.Conn) (*AuthContext, error) {
+	panic("boom")
+}
+
+func TestSOCKS5_CleanupOnFailure(t *testing.T) {
+	lAddr := closingListener(t)
+	port := []byte{byte(lAddr.Port >> 8), byte(lAddr.Port)}
+
+	for _, tc := range []struct {
+		name    string
+		conf    *Config
+		request []byte
+	}{
+		{"no data", &Config{}, nil},
+		{"bad version", &Config{}, []byte{4, 1, NoAuth}},
+		{"no methods", &Config{}, []byte{5}},
+		{"auth failure", &Config{Credentials: StaticCredentials{"foo": "bar"}},
+			[]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'}},
+		{"auth panic", &Config{AuthMethods: []Authenticator{panicAuthenticator{}}},
+			[]byte{5, 1, NoAuth}},
+		{"bad address type", &Config{}, []byte{5, 1, NoAuth, 5, ConnectCommand, 0, 9}},
+		{"truncated request", &Config{}, []byte{5, 1, NoAuth, 5, ConnectCommand}},
+		{"rule failure", &Config{Rules: PermitNone()},
+			append([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1}, port...)},
+		{"relay exhausted", &Config{ConnLimit: 1, HandshakeLimit: 0},
+			append([]byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1}, port...)},
+	} {
+		tc.conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+		serv, err := New(tc.conf)
+		if err != nil {
+			t.Fatalf("%v: err: %v", tc.name, err)
+		}
+		if tc.name == "relay exhausted" {
+			serv.sema <- struct{}{}
+		}
+
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serv.ServeConn(server)
+		}()
+		go func() {
+			client.Write(tc.request)
+			client.Close()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: ServeConn did not return", tc.name)
+		}
+
+		if tc.name == "relay exhausted" {
+			<-serv.sema
+		}
+		if n := serv.GetConnCount(); n != 0 {
+			t.Fatalf("%v: bad conn count: %v", tc.name, n)
+		}
+		if len(serv.sema) != 0 || len(serv.handshakeSema) != 0 {
+			t.Fatalf("%v: semaphore not released", tc.name)
+		}
+	}
+}
+
+type tagRecorder struct {
+	tags chan *AuthContext
+}
+
+func (r *tagRecorder) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.tags <- req.AuthContext
+	return ctx, false
+}
+
+func TestSOCKS5_UsernameTagParser(t *testing.T) {
+	rules := &tagRecorder{make(chan *AuthContext, 1)}
+	serv, err := New(&Config{
+		Credentials: StaticCredentials{"tenant1:foo": "bar"},
+		Rules:       rules,
+		UsernameTagParser: func(username string) (string, string) {
+			if i := strings.Index(username, ":"); i >= 0 {
+				return username[:i], username[i+1:]
+			}
+			return "", username
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	go serv.ServeConn(server)
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte{5, 1, UserPassAuth})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write(append([]byte{1, 11}, "tenant1:foo\x03bar"...))
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 80})
+
+	select {
+	case authContext := <-rules.tags:
+		if authContext.Tag != "tenant1" || authContext.username() != "foo" {
+			t.Fatalf("bad: %#v", authContext)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request not evaluated")
+	}
+}
+
+func TestSOCKS5_BindIPFallback(t *testing.T) {
+	var logs bytes.Buffer
+	serv, err := New(&Config{EnableBind: true, Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(logs.String(), "BindIP is not set") {
+		t.Fatalf("expected warning: %q", logs.String())
+	}
+	if ip := serv.bindIP(&MockConn{}); !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("bad: %v", ip)
+	}
+
+	logs.Reset()
+	serv, err = New(&Config{EnableBind: true, BindIP: net.IPv4(10, 0, 0, 1), Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected warning: %q", logs.String())
+	}
+	if ip := serv.bindIP(&MockConn{}); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("bad: %v", ip)
+	}
+}
+
+func TestSOCKS5_DialFunc(t *testing.T) {
+	echo := echoListener(t)
+	users := make(chan string, 1)
+	proxy := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			t.Errorf("Dial used instead of DialFunc")
+			return nil, io.EOF
+		},
+		DialFunc: func(ctx context.Context, req *Request, network, addr string) (net.Conn, error) {
+			users <- req.AuthContext.username()
+			return net.Dial(network, addr)
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	if user := <-users; user != "foo" {
+		t.Fatalf("bad: %v", user)
+	}
+}
+
+// connectReply sends a CONNECT for a domain resolving to dest and
+// returns the BND.ADDR and BND.PORT of the reply
+func connectReply(t *testing.T, conf *Config, dest *net.TCPAddr) (net.IP, int) {
+	conf.Resolver = staticResolver{dest.IP}
+	proxy := startServer(t, conf)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, fqdnAddress, 9}
+	req = append(req, "echo.test"...)
+	req = append(req, byte(dest.Port>>8), byte(dest.Port))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != successReply || out[5] != ipv4Address {
+		t.Fatalf("bad: %v", out)
+	}
+	return net.IP(out[6:10]), int(binary.BigEndian.Uint16(out[10:]))
+}
+
+func TestSOCKS5_ConnectReplyBindAddr(t *testing.T) {
+	echo := echoListener(t)
+
+	locals := make(chan *net.TCPAddr, 1)
+	ip, port := connectReply(t, &Config{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				locals <- conn.LocalAddr().(*net.TCPAddr)
+			}
+			return conn, err
+		},
+	}, echo)
+	if local := <-locals; !ip.Equal(local.IP) || port != local.Port {
+		t.Fatalf("expected outbound local address %v: %v:%v", local, ip, port)
+	}
+
+	ip, port = connectReply(t, &Config{ReplyRemoteAddr: true}, echo)
+	if !ip.Equal(echo.IP) || port != echo.Port {
+		t.Fatalf("expected resolved address: %v:%v", ip, port)
+	}
+
+	public := net.IPv4(192, 0, 2, 1)
+	ip, port = connectReply(t, &Config{AdvertisedBindAddr: public}, echo)
+	if !ip.Equal(public) || port == 0 || port == echo.Port {
+		t.Fatalf("expected advertised address: %v:%v", ip, port)
+	}
+}
+
+// countingConn counts the bytes written through it
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+func TestSOCKS5_WrapConns(t *testing.T) {
+	echo := echoListener(t)
+	var clientWritten, serverWritten int64
+	proxy := startServer(t, &Config{
+		WrapClientConn: func(c net.Conn) net.Conn {
+			return countingConn{c, &clientWritten}
+		},
+		WrapServerConn: func(c net.Conn) net.Conn {
+			return countingConn{c, &serverWritten}
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// Method selection, CONNECT reply and the echoed payload
+	if n := atomic.LoadInt64(&clientWritten); n != 2+10+4 {
+		t.Fatalf("bad client bytes: %v", n)
+	}
+	if n := atomic.LoadInt64(&serverWritten); n != 4 {
+		t.Fatalf("bad server bytes: %v", n)
+	}
+}
+
+// noDeadlineConn is a wrapped connection without deadline support
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (noDeadlineConn) SetDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines not supported")
+}
+
+func (noDeadlineConn) SetReadDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines not supported")
+}
+
+func (noDeadlineConn) SetWriteDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines not supported")
+}
+
+func TestSOCKS5_DeadlineErrorsLogged(t *testing.T) {
+	echo := echoListener(t)
+	logs := make(chanWriter, 100)
+	proxy := startServer(t, &Config{
+		WrapClientConn: func(c net.Conn) net.Conn {
+			return noDeadlineConn{c}
+		},
+		Logger: log.New(logs, "", log.LstdFlags),
+	})
+
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// Both the handshake deadline and the idle timeout of the relay
+	// are logged
+	expected := map[string]bool{"Failed to set deadline": true, "Failed to set read deadline": true}
+	for len(expected) != 0 {
+		select {
+		case line := <-logs:
+			for text := range expected {
+				if strings.Contains(line, text) {
+					delete(expected, text)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("not logged: %v", expected)
+		}
+	}
+}
+
+func TestNew_Validation(t *testing.T) {
+	cases := []struct {
+		conf *Config
+		err  string
+	}{
+		{&Config{IdleTimeout: -time.Second}, "IdleTimeout"},
+		{&Config{ConnectTimeout: -time.Second}, "ConnectTimeout"},
+		{&Config{StallTimeout: -time.Second}, "StallTimeout"},
+		{&Config{MaxAuthMethods: -1}, "MaxAuthMethods"},
+		{&Config{MaxAuthRounds: -1}, "MaxAuthRounds"},
+		{&Config{ReservedConnFraction: 1.5}, "ReservedConnFraction"},
+		{&Config{MaxConnDuration: -time.Second}, "MaxConnDuration"},
+		{&Config{MaxMemoryBytes: -1}, "MaxMemoryBytes"},
+		{&Config{BindIP: net.IPv4(10, 0, 0, 1)}, "BindIP"},
+		{&Config{AuthMethods: []Authenticator{NoAuthAuthenticator{}, NoAuthAuthenticator{}}}, "Duplicate auth method"},
+	}
+	for _, tc := range cases {
+		_, err := New(tc.conf)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("expected %q error, got: %v", tc.err, err)
+		}
+	}
+
+	// Zero values and unlimited limits are valid
+	if _, err := New(&Config{ConnLimit: -1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_OnConnFinished(t *testing.T) {
+	finished := make(chan FinishedConnInfo, 1)
+	conf := &Config{
+		Rules: &PermitCommand{EnableConnect: false},
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if reply := connectThrough(t, serv, dest); reply != ruleFailure {
+		t.Fatalf("bad: %v", reply)
+	}
+	if info := <-finished; info.CloseReason != ClosePolicyDenied {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	// Nothing listens on port 1
+	serv.SetRuleSet(PermitAll())
+	if reply := connectThrough(t, serv, dest); reply != connectionRefused {
+		t.Fatalf("bad: %v", reply)
+	}
+	if info := <-finished; info.CloseReason != CloseDialFailed || info.Error == nil {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestServeFromFD(t *testing.T) {
+	echo := echoListener(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	serv, err := New(&Config{ConnectTimeout: time.Second, IdleTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeFromFD(f)
+
+	d := &Dialer{ProxyAddr: l.Addr().String()}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func TestSOCKS5_MaxConnsPerUser(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{
+		Credentials:     StaticCredentials{"foo": "bar", "baz": "bar"},
+		MaxConnsPerUser: 1,
+	})
+
+	foo := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := foo.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+
+	if _, err := foo.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected limit error")
+	}
+
+	// Other users are counted separately
+	baz := &Dialer{ProxyAddr: proxy, Username: "baz", Password: "bar"}
+	other, err := baz.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	other.Close()
+
+	// Closing frees the slot
+	conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	conn, err = foo.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+// bufferConn records the socket options set on it
+type bufferConn struct {
+	MockConn
+	read, write int
+	nagle       bool
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.read = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.write = bytes
+	return nil
+}
+
+func (c *bufferConn) SetNoDelay(noDelay bool) error {
+	c.nagle = !noDelay
+	return nil
+}
+
+func TestSOCKS5_SocketOptions(t *testing.T) {
+	serv := &Server{config: &Config{ReadBufferSize: 1 << 20}}
+	conn := &bufferConn{}
+	serv.setSocketOptions(conn)
+	if conn.read != 1<<20 || conn.write != 0 || conn.nagle {
+		t.Fatalf("bad: %#v", conn)
+	}
+
+	serv = &Server{config: &Config{EnableNagle: true}}
+	conn = &bufferConn{}
+	serv.setSocketOptions(conn)
+	if !conn.nagle {
+		t.Fatalf("Nagle not enabled")
+	}
+
+	// Real TCP connections accept the sizes
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	var logs bytes.Buffer
+	serv = &Server{config: &Config{ReadBufferSize: 1 << 20, WriteBufferSize: 1 << 20, EnableNagle: true, Logger: log.New(&logs, "", 0)}}
+	serv.setSocketOptions(server)
+	if logs.Len() != 0 {
+		t.Fatalf("unexpected warning: %q", logs.String())
+	}
+}
+
+func TestSOCKS5_FinishedAuthMethod(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	select {
+	case info := <-finished:
+		if info.AuthMethod != UserPassAuth {
+			t.Fatalf("bad: %v", info.AuthMethod)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no finished event")
+	}
+}
+
+func TestSOCKS5_PipelinedData(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{})
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Method selection, request and payload in a single packet
+	req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1}
+	req = append(req, byte(echo.Port>>8), byte(echo.Port))
+	req = append(req, "ping"...)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make([]byte, 2+10+4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != successReply || string(out[12:]) != "ping" {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_Close(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	serv := startServerWith(t, &Config{
+		IdleTimeout: time.Minute,
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: serv.addr}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// A connection still negotiating
+	pending, err := net.Dial("tcp", serv.addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pending.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := serv.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, c := range []net.Conn{conn, pending} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected EOF, got: %v", err)
+		}
+	}
+	select {
+	case info := <-finished:
+		if info.CloseReason != CloseShutdown || info.Error != nil {
+			t.Fatalf("bad: %#v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("connection not finished")
+	}
+	if _, err := net.Dial("tcp", serv.addr); err == nil {
+		t.Fatalf("listener still open")
+	}
+	if err := serv.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSOCKS5_Shutdown(t *testing.T) {
+	echo := echoListener(t)
+	serv := startServerWith(t, &Config{IdleTimeout: time.Minute})
+
+	d := &Dialer{ProxyAddr: serv.addr}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- serv.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := net.Dial("tcp", serv.addr); err == nil {
+		t.Fatalf("listener still open")
+	}
+
+	// Established connections keep running until they finish
+	testEcho(t, conn)
+	select {
+	case err := <-done:
+		t.Fatalf("returned before draining: %v", err)
+	default:
+	}
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not drained")
+	}
+}
+
+func TestSOCKS5_ListenAndServeContext(t *testing.T) {
+	echo := echoListener(t)
+	serv, err := New(&Config{
+		IdleTimeout:         time.Minute,
+		ShutdownGracePeriod: 50 * time.Millisecond,
+		Logger:              log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serv.ListenAndServeContext(ctx, "tcp", addr) }()
+	time.Sleep(20 * time.Millisecond)
+
+	d := &Dialer{ProxyAddr: addr}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// The connection never finishes, so the grace period ends it
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not shut down")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+func TestSOCKS5_RequestFromContext(t *testing.T) {
+	echo := echoListener(t)
+	reqs := make(chan *Request, 1)
+	proxy := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Resolver:    staticResolver{echo.IP},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			req, ok := RequestFromContext(ctx)
+			if !ok {
+				return nil, fmt.Errorf("no request in context")
+			}
+			reqs <- req
+			return net.Dial(network, addr)
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar", RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	req := <-reqs
+	if req.AuthContext.username() != "foo" || req.DestAddr.FQDN != "echo.test" || req.RemoteAddr == nil {
+		t.Fatalf("bad: %#v", req)
+	}
+}
+
+func TestRequestFromContext_Missing(t *testing.T) {
+	if _, ok := RequestFromContext(context.Background()); ok {
+		t.Fatalf("expected no request")
+	}
+}
+
+func TestSOCKS5_TimeToFirstByte(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	testEcho(t, conn)
+	conn.Close()
+
+	select {
+	case info := <-finished:
+		if info.TimeToFirstByte < 30*time.Millisecond || info.TimeToFirstByte > info.Duration {
+			t.Fatalf("bad: %v of %v", info.TimeToFirstByte, info.Duration)
+		}
+		if info.BytesSent != 4 || info.BytesReceived != 4 {
+			t.Fatalf("bad: %#v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no finished event")
+	}
+}
+
+// userLimiter admits the connections of one user only
+type userLimiter struct {
+	user     string
+	released chan struct{}
+}
+
+func (l *userLimiter) Acquire(ctx context.Context) error {
+	req, ok := RequestFromContext(ctx)
+	if !ok || req.AuthContext.username() != l.user {
+		return fmt.Errorf("not admitted")
+	}
+	return nil
+}
+
+func (l *userLimiter) Release() {
+	l.released <- struct{}{}
+}
+
+func TestSOCKS5_Limiter(t *testing.T) {
+	echo := echoListener(t)
+	limiter := &userLimiter{user: "foo", released: make(chan struct{}, 1)}
+	proxy := startServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar", "baz": "bar"},
+		Limiter:     limiter,
+	})
+
+	foo := &Dialer{ProxyAddr: proxy, Username: "foo", Password: "bar"}
+	conn, err := foo.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+
+	baz := &Dialer{ProxyAddr: proxy, Username: "baz", Password: "bar"}
+	if _, err := baz.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected limiter error")
+	}
+
+	conn.Close()
+	select {
+	case <-limiter.released:
+	case <-time.After(time.Second):
+		t.Fatalf("limiter not released")
+	}
+}
+
+func TestSOCKS5_ReservedConnFraction(t *testing.T) {
+	echo := echoListener(t)
+	proxy := startServer(t, &Config{
+		Credentials:          StaticCredentials{"vip": "bar", "bulk": "bar"},
+		ConnLimit:            2,
+		ReservedConnFraction: 0.5,
+		PriorityFunc: func(req *Request) int {
+			if req.AuthContext.username() == "vip" {
+				return 1
+			}
+			return 0
+		},
+	})
+	vip := &Dialer{ProxyAddr: proxy, Username: "vip", Password: "bar"}
+	bulk := &Dialer{ProxyAddr: proxy, Username: "bulk", Password: "bar"}
+
+	// The unreserved slot is taken by bulk traffic
+	conn, err := bulk.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if _, err := bulk.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected limit")
+	}
+
+	// The reserved slot is left for priority traffic
+	conn, err = vip.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	if _, err := vip.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected limit")
+	}
+
+	// Closing gives the reserved slot back
+	conn.Close()
+	for i := 0; ; i++ {
+		conn, err = vip.Dial("tcp", echo.String())
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("reserved slot not released: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	testEcho(t, conn)
+	conn.Close()
+}
+
+func TestSOCKS5_MaxConnDuration(t *testing.T) {
+	echo := echoListener(t)
+	deadlines := make(chan time.Duration, 1)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		ConnectTimeout:  5 * time.Second,
+		MaxConnDuration: 200 * time.Millisecond,
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				deadlines <- 0
+			} else {
+				deadlines <- time.Until(deadline)
+			}
+			return net.Dial(network, addr)
+		},
+	})
+
+	start := time.Now()
+	conn, err := (&Dialer{ProxyAddr: proxy}).Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if d := <-deadlines; d <= 0 || d > 200*time.Millisecond {
+		t.Fatalf("bad dial deadline: %v", d)
+	}
+	testEcho(t, conn)
+
+	// The relay ends with the connection lifetime
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 900*time.Millisecond {
+		t.Fatalf("closed after %v", d)
+	}
+	if info := <-finished; info.CloseReason != CloseMaxDuration || info.Error != nil {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestSOCKS5_MisdirectedProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		request []byte
+		expect  string
+	}{
+		{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "looks like HTTP"},
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"), "looks like HTTP"},
+		{[]byte{tlsRecordHandshake, 3, 1, 0, 0}, "looks like TLS"},
+		{[]byte("GUESS"), "Unsupported SOCKS version"},
+		{[]byte{4, 1, 0, 80}, "Unsupported SOCKS version"},
+	} {
+		var logs bytes.Buffer
+		serv, err := New(&Config{Logger: log.New(&logs, "", log.LstdFlags)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			client.Write(tc.request)
+		}()
+		if err := serv.ServeConn(server); err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(logs.String(), tc.expect) {
+			t.Fatalf("%q: bad: %v", tc.request, logs.String())
+		}
+	}
+}
+
+func TestSOCKS5_SetAcceptingNewConnections(t *testing.T) {
+	echo := echoListener(t)
+	serv := startServerWith(t, &Config{})
+	d := &Dialer{ProxyAddr: serv.addr}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Established connections keep running, new ones are refused
+	serv.SetAcceptingNewConnections(false)
+	if _, err := d.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected error")
+	}
+	testEcho(t, conn)
+	conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	if n := serv.Stats().ConnCount; n != 0 {
+		t.Fatalf("bad: %v", n)
+	}
+
+	serv.SetAcceptingNewConnections(true)
+	conn, err = d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSOCKS5_FinishedDestAddr(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		Resolver: staticResolver{echo.IP},
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+
+	// Both the requested name and the dialed address are reported
+	info := <-finished
+	if info.DestAddr.FQDN != "echo.test" || info.DestAddr.Port != echo.Port {
+		t.Fatalf("bad: %v", info.DestAddr)
+	}
+	if !info.RealDestAddr.IP.Equal(echo.IP) || info.RealDestAddr.Port != echo.Port {
+		t.Fatalf("bad: %v", info.RealDestAddr)
+	}
+}
+
+// slowResolver resolves every name to ip after a delay
+type slowResolver struct {
+	ip    net.IP
+	delay time.Duration
+}
+
+func (r slowResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	time.Sleep(r.delay)
+	return ctx, r.ip, nil
+}
+
+func TestSOCKS5_PhaseTimings(t *testing.T) {
+	echo := echoListener(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServer(t, &Config{
+		Resolver: slowResolver{echo.IP, 20 * time.Millisecond},
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy, RemoteResolve: true}
+	conn, err := d.Dial("tcp", net.JoinHostPort("echo.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testEcho(t, conn)
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+
+	timings := (<-finished).Timings
+	if timings.Resolution < 20*time.Millisecond || timings.Dial <= 0 || timings.Relay < 10*time.Millisecond {
+		t.Fatalf("bad: %+v", timings)
+	}
+	if timings.Handshake <= 0 || timings.Auth <= 0 || timings.Auth > timings.Handshake {
+		t.Fatalf("bad: %+v", timings)
+	}
+}
+
+func TestSOCKS5_Exhausted(t *testing.T) {
+	echo := echoListener(t)
+	infos := make(chan ExhaustedInfo, 2)
+	serv := startServerWith(t, &Config{
+		HandshakeLimit: 1,
+		Limiter:        &userLimiter{user: "nobody"},
+		OnExhausted: func(info ExhaustedInfo) {
+			infos <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: serv.addr}
+	if _, err := d.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if info := <-infos; info.Limit != "relay" || info.ConnCount != 1 {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	// A client sending nothing holds the only handshake slot
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	time.Sleep(10 * time.Millisecond)
+	_, other := net.Pipe()
+	serv.ServeConn(other)
+	if info := <-infos; info.Limit != "handshake" || info.ConnCount != 1 {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	if n := serv.Stats().Exhausted; n != 2 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestSOCKS5_Denied(t *testing.T) {
+	echo := echoListener(t)
+	infos := make(chan DeniedInfo, 1)
+	serv := startServerWith(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Rules:       PermitNone(),
+		OnDenied: func(info DeniedInfo) {
+			infos <- info
+		},
+	})
+
+	d := &Dialer{ProxyAddr: serv.addr, Username: "foo", Password: "bar"}
+	if _, err := d.Dial("tcp", echo.String()); err == nil {
+		t.Fatalf("expected error")
+	}
+	info := <-infos
+	if info.Username != "foo" || info.IP != "127.0.0.1" || info.Command != ConnectCommand || info.ConnID == "" {
+		t.Fatalf("bad: %#v", info)
+	}
+	if info.DestAddr.String() != echo.String() || info.Timestamp.IsZero() {
+		t.Fatalf("bad: %#v", info)
+	}
+	if n := serv.Stats().Denied; n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+}
+
+func TestSOCKS5_FailureLinger(t *testing.T) {
+	for _, linger := range []time.Duration{0, 50 * time.Millisecond} {
+		var logs bytes.Buffer
+		proxy := startServer(t, &Config{
+			FailureLinger: linger,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, fmt.Errorf("connection refused")
+			},
+			Logger: log.New(&logs, "", log.LstdFlags),
+		})
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// The client pipelines data after its request, which the server
+		// never reads before replying
+		req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 1}
+		req = append(req, make([]byte, 64*1024)...)
+		go conn.Write(req)
+
+		start := time.Now()
+		out := make([]byte, 2+10)
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatalf("%v: err: %v", linger, err)
+		}
+		if out[3] != connectionRefused {
+			t.Fatalf("%v: bad: %v", linger, out)
+		}
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatalf("%v: err: %v", linger, err)
+		}
+		if time.Since(start) > 900*time.Millisecond {
+			t.Fatalf("%v: not closed after the reply", linger)
+		}
+		conn.Close()
+	}
+}
+
+func TestSOCKS5_ReplyOnExhausted(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		serv, err := New(&Config{
+			ConnLimit:        1,
+			ReplyOnExhausted: enabled,
+			FailureLinger:    10 * time.Millisecond,
+			Logger:           log.New(os.Stdout, "", log.LstdFlags),
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		serv.sema <- struct{}{}
+
+		client, server := net.Pipe()
+		go serv.ServeConn(server)
+		client.SetDeadline(time.Now().Add(time.Second))
+		req := []byte{5, 1, NoAuth, 5, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 1}
+		if _, err := client.Write(req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out, _ := io.ReadAll(client)
+		client.Close()
+		expect := []byte{5, NoAuth}
+		if enabled {
+			expect = append(expect, 5, serverFailure, 0, ipv4Address, 0, 0, 0, 0, 0, 0)
+		}
+		if !bytes.Equal(out, expect) {
+			t.Fatalf("%v: bad: %v", enabled, out)
+		}
+		if n := serv.Stats().Exhausted; n != 1 {
+			t.Fatalf("%v: bad: %v", enabled, n)
+		}
+	}
+}
+
+// connectTimeoutRules sets the connect timeout of every request
+type connectTimeoutRules time.Duration
+
+func (r connectTimeoutRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return WithConnectTimeout(ctx, time.Duration(r)), true
+}
+
+func TestSOCKS5_ConnectTimeoutOverride(t *testing.T) {
+	echo := echoListener(t)
+	deadlines := make(chan time.Duration, 1)
+	proxy := startServer(t, &Config{
+		Rules: connectTimeoutRules(50 * time.Millisecond),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			deadline, _ := ctx.Deadline()
+			deadlines <- time.Until(deadline)
+			return net.Dial(network, addr)
+		},
+	})
+
+	d := &Dialer{ProxyAddr: proxy}
+	conn, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if left := <-deadlines; left <= 0 || left > 50*time.Millisecond {
+		t.Fatalf("bad: %v", left)
+	}
+
+	// The timeout only applies to dialing
+	time.Sleep(100 * time.Millisecond)
+	testEcho(t, conn)
+}
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	echo := echoListener(t)
+	serv := startServerWith(t, &Config{
+		ConnectTimeout:   time.Minute,
+		HandshakeTimeout: 50 * time.Millisecond,
+	})
+
+	// A client connecting and sending nothing is dropped promptly
+	conn, err := net.Dial("tcp", serv.addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("dropped after %v", elapsed)
+	}
+
+	// Established connections outlive the handshake timeout
+	d := &Dialer{ProxyAddr: serv.addr}
+	relayed, err := d.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer relayed.Close()
+	time.Sleep(100 * time.Millisecond)
+	testEcho(t, relayed)
+}
+
+// ftpActiveServer serves one active mode FTP session, sending data for
+// RETR over a new connection to the address given by PORT
+func ftpActiveServer(t *testing.T, data string) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 Ready\r\n")
+		var dataAddr string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "PORT "):
+				f := strings.Split(line[len("PORT "):], ",")
+				if len(f) != 6 {
+					fmt.Fprintf(conn, "501 Bad PORT\r\n")
+					continue
+				}
+				p1, _ := strconv.Atoi(f[4])
+				p2, _ := strconv.Atoi(f[5])
+				dataAddr = net.JoinHostPort(strings.Join(f[:4], "."), strconv.Itoa(p1<<8|p2))
+				fmt.Fprintf(conn, "200 PORT command successful\r\n")
+			case strings.HasPrefix(line, "RETR "):
+				fmt.Fprintf(conn, "150 Opening data connection\r\n")
+				dc, err := net.Dial("tcp", dataAddr)
+				if err != nil {
+					fmt.Fprintf(conn, "425 Can't open data connection\r\n")
+					continue
+				}
+				dc.Write([]byte(data))
+				dc.Close()
+				fmt.Fprintf(conn, "226 Transfer complete\r\n")
+			case line == "QUIT":
+				fmt.Fprintf(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "502 Not implemented\r\n")
+			}
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// bind sends a BIND request for a connection from dest and returns the
+// connection to the proxy and the bound address of the first reply
+func bind(t *testing.T, proxy string, dest *net.TCPAddr) (net.Conn, *net.TCPAddr) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{5, 1, NoAuth, 5, BindCommand, 0, ipv4Address}
+	req = append(req, dest.IP.To4()...)
+	req = append(req, byte(dest.Port>>8), byte(dest.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != successReply {
+		t.Fatalf("bad: %v", out)
+	}
+	return conn, &net.TCPAddr{IP: net.IP(out[6:10]), Port: int(binary.BigEndian.Uint16(out[10:]))}
+}
+
+// bindPeer reads the second reply of a BIND and returns the peer address
+func bindPeer(t *testing.T, conn net.Conn) *net.TCPAddr {
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != successReply {
+		t.Fatalf("bad: %v", out)
+	}
+	return &net.TCPAddr{IP: net.IP(out[4:8]), Port: int(binary.BigEndian.Uint16(out[8:]))}
+}
+
+func TestSOCKS5_Bind_FTPActiveMode(t *testing.T) {
+	ftp := ftpActiveServer(t, "file contents")
+	serv := startServerWith(t, &Config{EnableBind: true, BindIP: net.IPv4(127, 0, 0, 1)})
+
+	// The control channel is a CONNECT
+	d := &Dialer{ProxyAddr: serv.addr}
+	ctrl, err := d.Dial("tcp", ftp.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(time.Second))
+	ctrlReader := bufio.NewReader(ctrl)
+	expect := func(code string) {
+		line, err := ctrlReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !strings.HasPrefix(line, code+" ") {
+			t.Fatalf("expected %v, got: %q", code, line)
+		}
+	}
+	expect("220")
+
+	// The data channel is a BIND for a connection from the FTP server
+	data, bound := bind(t, serv.addr, &net.TCPAddr{IP: ftp.IP})
+	defer data.Close()
+
+	// Tell the FTP server to connect to the bound address
+	fmt.Fprintf(ctrl, "PORT %s,%d,%d\r\n", strings.Replace(bound.IP.String(), ".", ",", -1), bound.Port>>8, bound.Port&0xff)
+	expect("200")
+	fmt.Fprintf(ctrl, "RETR file\r\n")
+	expect("150")
+
+	// The second reply tells the connection came from the FTP server
+	if peer := bindPeer(t, data); !peer.IP.Equal(ftp.IP) {
+		t.Fatalf("bad: %v", peer)
+	}
+	contents, err := io.ReadAll(data)
+	if err != nil || string(contents) != "file contents" {
+		t.Fatalf("bad: %q %v", contents, err)
+	}
+	expect("226")
+
+	fmt.Fprintf(ctrl, "QUIT\r\n")
+	expect("221")
+}
+
+func TestSOCKS5_BindWait(t *testing.T) {
+	finished := make(chan FinishedConnInfo, 1)
+	conf := func(maxDuration time.Duration) *Config {
+		return &Config{
+			EnableBind:      true,
+			BindIP:          net.IPv4(127, 0, 0, 1),
+			MaxConnDuration: maxDuration,
+			OnConnFinished: func(info FinishedConnInfo) {
+				finished <- info
+			},
+		}
+	}
+	peer := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// The client hanging up ends the wait and closes the listener
+	serv := startServerWith(t, conf(0))
+	conn, bound := bind(t, serv.addr, peer)
+	if active := serv.ActiveConnections(); len(active) != 1 {
+		t.Fatalf("bad: %v", active)
+	}
+	conn.Close()
+	if info := <-finished; info.CloseReason != CloseClientEOF {
+		t.Fatalf("bad: %#v", info)
+	}
+	if c, err := net.Dial("tcp", bound.String()); err == nil {
+		c.Close()
+		t.Fatalf("listener still open")
+	}
+	if active := serv.ActiveConnections(); len(active) != 0 {
+		t.Fatalf("bad: %v", active)
+	}
+
+	// MaxConnDuration ends the wait with a failure reply
+	serv = startServerWith(t, conf(100*time.Millisecond))
+	conn, _ = bind(t, serv.addr, peer)
+	out := make([]byte, 10)
+	if _, err := io.ReadFull(conn, out); err != nil || out[1] != serverFailure {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+	conn.Close()
+	if info := <-finished; info.CloseReason != CloseMaxDuration {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	// Close ends the wait as well
+	serv = startServerWith(t, conf(0))
+	conn, _ = bind(t, serv.addr, peer)
+	defer conn.Close()
+	serv.Close()
+	if _, err := conn.Read(out); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+	if info := <-finished; info.CloseReason != CloseShutdown {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestSOCKS5_EnforceBindPeer(t *testing.T) {
+	// Reserve the port the peer is expected to connect from
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	for _, enforce := range []bool{false, true} {
+		serv := startServerWith(t, &Config{
+			EnableBind:      true,
+			BindIP:          net.IPv4(127, 0, 0, 1),
+			EnforceBindPeer: enforce,
+		})
+		conn, bound := bind(t, serv.addr, expected)
+
+		// A connection from another port
+		other, err := net.Dial("tcp", bound.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		other.SetDeadline(time.Now().Add(time.Second))
+		if !enforce {
+			if peer := bindPeer(t, conn); peer.Port != other.LocalAddr().(*net.TCPAddr).Port {
+				t.Fatalf("bad: %v", peer)
+			}
+			other.Close()
+			conn.Close()
+			continue
+		}
+		if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected mismatch to be dropped, got: %v", err)
+		}
+		other.Close()
+
+		d := net.Dialer{LocalAddr: expected}
+		peerConn, err := d.Dial("tcp", bound.String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer peerConn.Close()
+		if peer := bindPeer(t, conn); peer.Port != expected.Port {
+			t.Fatalf("bad: %v", peer)
+		}
+		peerConn.Write([]byte("ping"))
+		out := make([]byte, 4)
+		if _, err := io.ReadFull(conn, out); err != nil || string(out) != "ping" {
+			t.Fatalf("bad: %q %v", out, err)
+		}
+		conn.Close()
+	}
 }
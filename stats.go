@@ -0,0 +1,257 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Stats is a snapshot of the server counters
+type Stats struct {
+	// ConnCount is the number of currently served connections
+	ConnCount int64
+	// Replies counts the replies sent to clients,
+	// keyed by the RFC 1928 reply code
+	Replies map[uint8]int64
+	// FailedReplies counts the failure replies keyed by the destination
+	// label, see Config.FailureDestLabel, and then by the reply code
+	FailedReplies map[string]map[uint8]int64
+	// Stalled is the number of relays closed by the StallTimeout
+	Stalled int64
+	// RateLimited is the number of connections rejected by the
+	// MaxNewConnsPerSec limits
+	RateLimited int64
+	// Exhausted is the number of connections refused because the
+	// HandshakeLimit, ConnLimit, Limiter or MaxMemoryBytes was exhausted
+	Exhausted int64
+	// Denied is the number of requests denied by the RuleSet
+	Denied int64
+	// UDPAssociations is the number of active UDP ASSOCIATE relays
+	UDPAssociations int64
+	// EstimatedMemoryBytes is a coarse estimate of the memory held by
+	// the served connections: ConnCount times the handshake buffer and
+	// the relay buffers of both directions, plus the datagram buffer of
+	// each of the UDPAssociations
+	EstimatedMemoryBytes int64
+	// Resolutions counts name resolutions keyed by the resolver type,
+	// e.g. "socks5.DNSResolver"
+	Resolutions map[string]ResolutionStats
+}
+
+// ResolutionStats are the counters of a resolver type
+type ResolutionStats struct {
+	Successes int64
+	Failures  int64
+	// Duration is the total time spent resolving,
+	// divide by the number of resolutions for the average latency
+	Duration time.Duration
+}
+
+// DestLabel is how destinations are labelled in Stats().FailedReplies
+type DestLabel int
+
+const (
+	// DestLabelNone doesn't count failures by destination
+	DestLabelNone DestLabel = iota
+	// DestLabelRaw labels with the requested host and port
+	DestLabelRaw
+	// DestLabelHashed labels with a short hash of the requested host
+	// and port, so the destinations don't leak into metrics
+	DestLabelHashed
+)
+
+// maxFailureDests bounds the destinations counted in FailedReplies,
+// failures of further destinations are counted as otherFailureDest
+const maxFailureDests = 1024
+
+// otherFailureDest is the label of the destinations over maxFailureDests
+const otherFailureDest = "other"
+
+// serverStats holds the cumulative counters of a Server.
+// The zero value is ready to use.
+type serverStats struct {
+	replies     [256]int64
+	stalled     int64
+	rateLimited int64
+	exhausted   int64
+	denied      int64
+	// udpAssociations is a gauge, not a cumulative counter
+	udpAssociations int64
+
+	resolutionsLock sync.Mutex
+	resolutions     map[string]ResolutionStats
+
+	failedRepliesLock sync.Mutex
+	failedReplies     map[string]map[uint8]int64
+}
+
+// Stats returns a snapshot of the server counters
+func (s *Server) Stats() Stats {
+	return s.snapshotStats(false)
+}
+
+// StatsAndReset returns a snapshot of the server counters like Stats and
+// resets the cumulative ones to zero, e.g. for interval reporting. Each
+// counter is swapped atomically, so no event is lost or counted in two
+// intervals. The gauges ConnCount and UDPAssociations are kept.
+func (s *Server) StatsAndReset() Stats {
+	return s.snapshotStats(true)
+}
+
+// snapshotStats returns the counters, resetting the cumulative ones
+func (s *Server) snapshotStats(reset bool) Stats {
+	load := atomic.LoadInt64
+	if reset {
+		load = func(addr *int64) int64 { return atomic.SwapInt64(addr, 0) }
+	}
+	stats := Stats{
+		ConnCount:       s.GetConnCount(),
+		Replies:         make(map[uint8]int64),
+		Stalled:         load(&s.stats.stalled),
+		RateLimited:     load(&s.stats.rateLimited),
+		Exhausted:       load(&s.stats.exhausted),
+		Denied:          load(&s.stats.denied),
+		UDPAssociations: atomic.LoadInt64(&s.stats.udpAssociations),
+	}
+	stats.EstimatedMemoryBytes = memoryEstimate(stats.ConnCount, stats.UDPAssociations)
+	for code := range s.stats.replies {
+		if n := load(&s.stats.replies[code]); n != 0 {
+			stats.Replies[uint8(code)] = n
+		}
+	}
+	s.stats.resolutionsLock.Lock()
+	stats.Resolutions = make(map[string]ResolutionStats, len(s.stats.resolutions))
+	for name, r := range s.stats.resolutions {
+		stats.Resolutions[name] = r
+	}
+	if reset {
+		s.stats.resolutions = nil
+	}
+	s.stats.resolutionsLock.Unlock()
+	s.stats.failedRepliesLock.Lock()
+	stats.FailedReplies = make(map[string]map[uint8]int64, len(s.stats.failedReplies))
+	for dest, codes := range s.stats.failedReplies {
+		stats.FailedReplies[dest] = make(map[uint8]int64, len(codes))
+		for code, n := range codes {
+			stats.FailedReplies[dest][code] = n
+		}
+	}
+	if reset {
+		s.stats.failedReplies = nil
+	}
+	s.stats.failedRepliesLock.Unlock()
+	return stats
+}
+
+// sendReply sends a reply message and records its code
+func (s *Server) sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if err := sendReply(w, resp, addr); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.stats.replies[resp], 1)
+	return nil
+}
+
+// reply sends a reply to a request and records its outcome
+func (s *Server) reply(req *Request, w io.Writer, resp uint8, addr *AddrSpec) error {
+	if err := s.sendReply(w, resp, addr); err != nil {
+		return err
+	}
+	req.replyCode = resp
+	req.replied = true
+	if resp != successReply {
+		s.recordFailedReply(req, resp)
+	}
+	return nil
+}
+
+// recordFailedReply counts a failure reply by the destination of req
+func (s *Server) recordFailedReply(req *Request, resp uint8) {
+	mode := s.config.FailureDestLabel
+	if mode == DestLabelNone || req.DestAddr == nil {
+		return
+	}
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	label := net.JoinHostPort(host, fmt.Sprint(req.DestAddr.Port))
+	if mode == DestLabelHashed {
+		label = redact(label)
+	}
+
+	s.stats.failedRepliesLock.Lock()
+	defer s.stats.failedRepliesLock.Unlock()
+	if s.stats.failedReplies == nil {
+		s.stats.failedReplies = make(map[string]map[uint8]int64)
+	}
+	codes, ok := s.stats.failedReplies[label]
+	if !ok {
+		if len(s.stats.failedReplies) >= maxFailureDests {
+			label = otherFailureDest
+			codes = s.stats.failedReplies[label]
+		}
+		if codes == nil {
+			codes = make(map[uint8]int64)
+			s.stats.failedReplies[label] = codes
+		}
+	}
+	codes[resp]++
+}
+
+// connMemoryEstimate is the estimated memory of a served connection, the
+// bufio.Reader of the handshake and a relay buffer per direction
+const connMemoryEstimate = 4096 + 2*relayBufferSize
+
+// memoryEstimate is the estimated memory of conns served connections,
+// of which associations relay UDP with a datagram buffer of their own
+func memoryEstimate(conns, associations int64) int64 {
+	return conns*connMemoryEstimate + associations*maxUDPPacketSize
+}
+
+// estimatedMemory returns the estimated memory of the served connections
+func (s *Server) estimatedMemory() int64 {
+	return memoryEstimate(s.GetConnCount(), atomic.LoadInt64(&s.stats.udpAssociations))
+}
+
+// resolve resolves name with the current resolver and records the
+// outcome and latency of the resolution
+func (s *Server) resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	resolver := s.nameResolver()
+	start := time.Now()
+	ctx, addr, err := resolver.Resolve(ctx, name)
+	s.recordResolution(resolver, time.Since(start), err)
+	return ctx, addr, err
+}
+
+// resolveAll is like resolve but returns every address of name
+func (s *Server) resolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	resolver := s.nameResolver()
+	start := time.Now()
+	ctx, addrs, err := resolveAll(resolver, ctx, name)
+	s.recordResolution(resolver, time.Since(start), err)
+	return ctx, addrs, err
+}
+
+// recordResolution counts a resolution by the type of its resolver
+func (s *Server) recordResolution(resolver NameResolver, elapsed time.Duration, err error) {
+	key := fmt.Sprintf("%T", resolver)
+	s.stats.resolutionsLock.Lock()
+	defer s.stats.resolutionsLock.Unlock()
+	if s.stats.resolutions == nil {
+		s.stats.resolutions = make(map[string]ResolutionStats)
+	}
+	r := s.stats.resolutions[key]
+	if err != nil {
+		r.Failures++
+	} else {
+		r.Successes++
+	}
+	r.Duration += elapsed
+	s.stats.resolutions[key] = r
+}
@@ -0,0 +1,180 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestStats_Replies(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		Rules:  &PermitCommand{EnableConnect: true},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{IP: lAddr.IP, Port: lAddr.Port}
+	connectThrough(t, serv, dest)
+	connectThrough(t, serv, dest)
+	serv.SetRuleSet(PermitNone())
+	connectThrough(t, serv, dest)
+	time.Sleep(10 * time.Millisecond)
+
+	stats := serv.Stats()
+	if stats.Replies[successReply] != 2 || stats.Replies[ruleFailure] != 1 {
+		t.Fatalf("bad: %v", stats.Replies)
+	}
+	if len(stats.Replies) != 2 {
+		t.Fatalf("bad: %v", stats.Replies)
+	}
+}
+
+func TestStats_Resolutions(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		Resolver: staticResolver{lAddr.IP},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{FQDN: "example.test", Port: lAddr.Port}
+	connectThrough(t, serv, dest)
+	serv.SetResolver(failingResolver{})
+	connectThrough(t, serv, dest)
+
+	stats := serv.Stats()
+	static := stats.Resolutions["socks5.staticResolver"]
+	failing := stats.Resolutions["socks5.failingResolver"]
+	if static.Successes != 1 || static.Failures != 0 || failing.Failures != 1 {
+		t.Fatalf("bad: %v", stats.Resolutions)
+	}
+}
+
+func TestStats_Reset(t *testing.T) {
+	lAddr := closingListener(t)
+
+	serv, err := New(&Config{
+		Resolver: staticResolver{lAddr.IP},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dest := &AddrSpec{FQDN: "example.test", Port: lAddr.Port}
+	connectThrough(t, serv, dest)
+	connectThrough(t, serv, dest)
+
+	// A connection still negotiating keeps the ConnCount gauge up
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	time.Sleep(10 * time.Millisecond)
+
+	stats := serv.StatsAndReset()
+	if stats.Replies[successReply] != 2 || len(stats.Resolutions) != 1 || stats.ConnCount != 1 {
+		t.Fatalf("bad: %+v", stats)
+	}
+	stats = serv.Stats()
+	if len(stats.Replies) != 0 || len(stats.Resolutions) != 0 || stats.ConnCount != 1 {
+		t.Fatalf("not reset: %+v", stats)
+	}
+}
+
+func TestStats_FailedReplies(t *testing.T) {
+	for _, tc := range []struct {
+		mode   DestLabel
+		expect string
+	}{
+		{DestLabelNone, ""},
+		{DestLabelRaw, "down.test:80"},
+		{DestLabelHashed, "sha256:"},
+	} {
+		serv, err := New(&Config{
+			Resolver:         staticResolver{net.IPv4(192, 0, 2, 1)},
+			FailureDestLabel: tc.mode,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, fmt.Errorf("connection refused")
+			},
+			Logger: log.New(os.Stdout, "", log.LstdFlags),
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		connectThrough(t, serv, &AddrSpec{FQDN: "down.test", Port: 80})
+		connectThrough(t, serv, &AddrSpec{FQDN: "down.test", Port: 80})
+		time.Sleep(10 * time.Millisecond)
+
+		failed := serv.Stats().FailedReplies
+		if tc.mode == DestLabelNone {
+			if len(failed) != 0 {
+				t.Fatalf("bad: %v", failed)
+			}
+			continue
+		}
+		if len(failed) != 1 {
+			t.Fatalf("bad: %v", failed)
+		}
+		for label, codes := range failed {
+			if !strings.HasPrefix(label, tc.expect) || strings.Contains(label, "down") != (tc.mode == DestLabelRaw) {
+				t.Fatalf("bad label: %v", label)
+			}
+			if codes[connectionRefused] != 2 || len(codes) != 1 {
+				t.Fatalf("bad: %v", codes)
+			}
+		}
+	}
+}
+
+func TestStats_MaxMemoryBytes(t *testing.T) {
+	infos := make(chan ExhaustedInfo, 1)
+	serv, err := New(&Config{
+		MaxMemoryBytes: connMemoryEstimate,
+		OnExhausted: func(info ExhaustedInfo) {
+			infos <- info
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A client sending nothing holds the only connection the estimate allows
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeConn(server)
+	for i := 0; serv.GetConnCount() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("connection not served")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := serv.Stats().EstimatedMemoryBytes; n != connMemoryEstimate {
+		t.Fatalf("bad: %v", n)
+	}
+
+	_, other := net.Pipe()
+	if err := serv.ServeConn(other); err == nil || !strings.Contains(err.Error(), "MaxMemoryBytes") {
+		t.Fatalf("err: %v", err)
+	}
+	if info := <-infos; info.Limit != "memory" {
+		t.Fatalf("bad: %#v", info)
+	}
+	if n := serv.Stats().Exhausted; n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+}
@@ -0,0 +1,248 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxUDPPacketSize is the largest datagram relayed for an association
+const maxUDPPacketSize = 64 * 1024
+
+// errTooManyAssociations is reported when MaxUDPAssociations is reached
+var errTooManyAssociations = fmt.Errorf("Too many UDP associations")
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE
+type udpAssociation struct {
+	s     *Server
+	ctx   context.Context
+	req   *Request
+	rules RuleSet
+	conn  *net.UDPConn
+	// clientIP is the address of the control connection, only datagrams
+	// from it are relayed to destinations
+	clientIP net.IP
+	// client is the UDP address of the client, learned from the request
+	// or its first datagram
+	client *net.UDPAddr
+	// sent and received count the payload bytes relayed to and from
+	// destinations
+	sent, received int64
+}
+
+// handleAssociate is used to handle an associate command
+func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, req *Request, rules RuleSet) error {
+	finish := s.connFinisher(req, conn)
+
+	// Check if this is allowed
+	if ctx_, ok := rules.Allow(ctx, req); !ok {
+		finish(ClosePolicyDenied, nil, 0, 0)
+		if err := s.deny(req, conn); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
+	} else {
+		ctx = ctx_
+	}
+
+	// Enforce the limit of concurrent associations
+	n := atomic.AddInt64(&s.stats.udpAssociations, 1)
+	defer atomic.AddInt64(&s.stats.udpAssociations, -1)
+	if max := s.config.MaxUDPAssociations; max > 0 && n > int64(max) {
+		finish(CloseError, errTooManyAssociations, 0, 0)
+		if err := s.reply(req, conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to associate: %v", errTooManyAssociations)
+	}
+
+	s.connStarted(req, conn)
+	ac := s.trackConn(req, conn)
+	defer s.untrackConn(ac)
+
+	// Open the relay socket on the advertised address, unless a separate
+	// address is advertised
+	listenIP := s.bindIP(conn)
+	if s.config.UDPAdvertiseIP != nil {
+		listenIP = s.config.BindIP
+	}
+	udpConn, err := net.ListenUDP(s.udpNetwork(), &net.UDPAddr{IP: listenIP})
+	if err != nil {
+		finish(CloseError, err, 0, 0)
+		if err := s.reply(req, conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to open UDP relay: %v", err)
+	}
+	defer udpConn.Close()
+
+	local := udpConn.LocalAddr().(*net.UDPAddr)
+	advertised := &AddrSpec{IP: local.IP, Port: local.Port}
+	if ip := s.config.UDPAdvertiseIP; ip != nil {
+		advertised.IP = ip
+	}
+	if err := s.reply(req, conn, successReply, advertised); err != nil {
+		finish(CloseError, err, 0, 0)
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	assoc := &udpAssociation{s: s, ctx: ctx, req: req, rules: rules, conn: udpConn}
+	if req.RemoteAddr != nil {
+		assoc.clientIP = req.RemoteAddr.IP
+	}
+	if dest := req.DestAddr; dest.IP != nil && !dest.IP.IsUnspecified() && dest.Port != 0 {
+		assoc.client = &net.UDPAddr{IP: dest.IP, Port: dest.Port}
+	}
+
+	// The association ends with the control connection, or when the
+	// context is done, e.g. with the MaxConnDuration
+	s.setDeadline(conn, time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				udpConn.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	relayStart := time.Now()
+	reason, err := assoc.relay()
+	conn.Close()
+	<-done
+	req.timings.Relay = time.Since(relayStart)
+
+	// Closing the relay socket ends the association, which is done when
+	// the client hangs up, and by Close, Shutdown and the context
+	switch {
+	case s.isTerminating():
+		reason, err = CloseShutdown, nil
+	case ctx.Err() == context.DeadlineExceeded:
+		reason, err = CloseMaxDuration, nil
+	}
+	req.bytesSent = atomic.LoadInt64(&assoc.sent)
+	req.bytesReceived = atomic.LoadInt64(&assoc.received)
+	finish(reason, err, req.bytesSent, req.bytesReceived)
+	return err
+}
+
+// udpNetwork returns the UDP network matching the OutboundNetwork
+func (s *Server) udpNetwork() string {
+	return strings.Replace(s.outboundNetwork(), "tcp", "udp", 1)
+}
+
+// relay moves datagrams until the relay socket is closed or idle, and
+// returns why it stopped
+func (a *udpAssociation) relay() (CloseReason, error) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		if timeout := a.s.config.IdleTimeout; timeout > 0 {
+			a.s.setReadDeadline(a.conn, time.Now().Add(timeout))
+		}
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return CloseIdleTimeout, nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return CloseClientEOF, nil
+			}
+			return CloseError, fmt.Errorf("Failed to read UDP datagram: %v", err)
+		}
+
+		if a.fromClient(from) {
+			a.forward(buf[:n])
+		} else if a.client != nil {
+			a.reply(from, buf[:n])
+		}
+	}
+}
+
+// fromClient checks if a datagram was sent by the client, the first one
+// from the client IP determines the client port if it was not requested
+func (a *udpAssociation) fromClient(from *net.UDPAddr) bool {
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+	if a.clientIP == nil || a.clientIP.Equal(from.IP) {
+		a.client = from
+		return true
+	}
+	return false
+}
+
+// forward sends a datagram of the client to its destination. Fragmented
+// datagrams (FRAG != 0) are dropped, as reassembly is not supported.
+func (a *udpAssociation) forward(packet []byte) {
+	if len(packet) < 4 || packet[0] != 0 || packet[1] != 0 {
+		a.s.config.Logger.Printf("[WARN] socks: Dropping malformed UDP datagram from %v", a.client)
+		return
+	}
+	if frag := packet[2]; frag != 0 {
+		a.s.config.Logger.Printf("[WARN] socks: Dropping fragmented UDP datagram (FRAG=%d) from %v, reassembly is not supported", frag, a.client)
+		return
+	}
+
+	r := bytes.NewReader(packet[3:])
+	dest, err := readAddrSpec(r)
+	if err != nil {
+		a.s.config.Logger.Printf("[WARN] socks: Dropping UDP datagram with bad address from %v: %v", a.client, err)
+		return
+	}
+	data := packet[len(packet)-r.Len():]
+
+	if dest.FQDN != "" {
+		_, addr, err := a.s.resolve(a.ctx, dest.FQDN)
+		if err != nil {
+			a.s.config.Logger.Printf("[WARN] socks: Failed to resolve UDP destination '%v': %v", dest.FQDN, err)
+			return
+		}
+		dest.IP = addr
+	}
+
+	// Check the destination against the rules like a request of its own
+	dreq := *a.req
+	dreq.DestAddr = dest
+	dreq.realDestAddr = dest
+	if _, ok := a.rules.Allow(context.WithValue(a.ctx, requestKey{}, &dreq), &dreq); !ok {
+		a.s.config.Logger.Printf("[WARN] socks: Dropping UDP datagram to %v blocked by rules", dest)
+		return
+	}
+	if _, err := a.conn.WriteToUDP(data, &net.UDPAddr{IP: dest.IP, Port: dest.Port}); err != nil {
+		a.s.config.Logger.Printf("[WARN] socks: Failed to send UDP datagram to %v: %v", dest, err)
+		return
+	}
+	atomic.AddInt64(&a.sent, int64(len(data)))
+}
+
+// reply sends a datagram of a remote host to the client with a header
+// telling where it came from
+func (a *udpAssociation) reply(from *net.UDPAddr, data []byte) {
+	header, err := formatMessage(0, &AddrSpec{IP: from.IP, Port: from.Port})
+	if err != nil {
+		return
+	}
+	// The UDP header has RSV and FRAG in place of version and reply code
+	header[0], header[1] = 0, 0
+	if _, err := a.conn.WriteToUDP(append(header, data...), a.client); err != nil {
+		a.s.config.Logger.Printf("[WARN] socks: Failed to send UDP datagram to %v: %v", a.client, err)
+		return
+	}
+	atomic.AddInt64(&a.received, int64(len(data)))
+}
@@ -0,0 +1,307 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// udpEchoServer echoes every datagram back to its sender
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// associate sends an ASSOCIATE over a new control connection and
+// returns it with the UDP relay address of the reply
+func associate(t *testing.T, proxy string) (net.Conn, *net.UDPAddr) {
+	ctrl, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(time.Second))
+	req := []byte{5, 1, NoAuth, 5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0}
+	if _, err := ctrl.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(ctrl, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != successReply {
+		t.Fatalf("bad: %v", out)
+	}
+	return ctrl, &net.UDPAddr{IP: net.IP(out[6:10]), Port: int(binary.BigEndian.Uint16(out[10:]))}
+}
+
+func udpDatagram(frag byte, dest *net.UDPAddr, data string) []byte {
+	packet := []byte{0, 0, frag, ipv4Address}
+	packet = append(packet, dest.IP.To4()...)
+	packet = append(packet, byte(dest.Port>>8), byte(dest.Port))
+	return append(packet, data...)
+}
+
+func TestSOCKS5_Associate(t *testing.T) {
+	echo := udpEchoServer(t)
+	proxy := startServer(t, &Config{EnableAssociate: true})
+	ctrl, relay := associate(t, proxy)
+	defer ctrl.Close()
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := client.Write(udpDatagram(0, echo, "ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := udpDatagram(0, echo, "ping"); !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("bad: %v %v", buf[:n], expected)
+	}
+}
+
+func TestSOCKS5_Associate_DropsFragments(t *testing.T) {
+	echo := udpEchoServer(t)
+	proxy := startServer(t, &Config{EnableAssociate: true})
+	ctrl, relay := associate(t, proxy)
+	defer ctrl.Close()
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	client.Write(udpDatagram(1, echo, "frag"))
+	client.Write(udpDatagram(0, echo, "ping"))
+
+	// Only the unfragmented datagram comes back
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("ping")) {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestSOCKS5_Associate_AdvertiseIP(t *testing.T) {
+	echo := udpEchoServer(t)
+	public := net.IPv4(192, 0, 2, 1)
+	proxy := startServer(t, &Config{EnableAssociate: true, UDPAdvertiseIP: public})
+	ctrl, relay := associate(t, proxy)
+	defer ctrl.Close()
+	if !relay.IP.Equal(public) {
+		t.Fatalf("bad: %v", relay)
+	}
+
+	// The relay listens on all addresses
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relay.Port})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(udpDatagram(0, echo, "ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := udpDatagram(0, echo, "ping"); !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("bad: %v %v", buf[:n], expected)
+	}
+
+	if _, err := New(&Config{UDPAdvertiseIP: public}); err == nil {
+		t.Fatalf("expected error without ASSOCIATE")
+	}
+}
+
+func TestSOCKS5_Associate_EndsWithControlConn(t *testing.T) {
+	proxy := startServer(t, &Config{EnableAssociate: true})
+	ctrl, relay := associate(t, proxy)
+	ctrl.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// The relay socket is closed, so the port is free again
+	conn, err := net.ListenUDP("udp", relay)
+	if err != nil {
+		t.Fatalf("relay still open: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSOCKS5_Associate_Tracked(t *testing.T) {
+	echo := udpEchoServer(t)
+	finished := make(chan FinishedConnInfo, 1)
+	proxy := startServerWith(t, &Config{
+		EnableAssociate: true,
+		OnConnFinished: func(info FinishedConnInfo) {
+			finished <- info
+		},
+	})
+	ctrl, relay := associate(t, proxy.addr)
+	defer ctrl.Close()
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(udpDatagram(0, echo, "ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 1024)
+	if _, err := client.Read(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conns := proxy.ActiveConnections()
+	if len(conns) != 1 {
+		t.Fatalf("bad: %v", conns)
+	}
+	if !proxy.CloseConnection(conns[0].ConnID) {
+		t.Fatalf("expected the association to be closed")
+	}
+	select {
+	case info := <-finished:
+		if info.CloseReason != CloseClientEOF || info.BytesSent != 4 || info.BytesReceived != 4 {
+			t.Fatalf("bad: %#v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("association did not finish")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(proxy.ActiveConnections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("association was not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// denyAssociatePort denies ASSOCIATE towards one port only
+type denyAssociatePort int
+
+func (p denyAssociatePort) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.Command != AssociateCommand || req.DestAddr.Port != int(p)
+}
+
+func TestSOCKS5_Associate_RuleFail(t *testing.T) {
+	proxy := startServer(t, &Config{
+		EnableAssociate: true,
+		Rules:           &PermitCommand{EnableConnect: true},
+	})
+	ctrl, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(time.Second))
+	ctrl.Write([]byte{5, 1, NoAuth, 5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(ctrl, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != ruleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestSOCKS5_Associate_DatagramRuleFail(t *testing.T) {
+	denied := udpEchoServer(t)
+	echo := udpEchoServer(t)
+	proxy := startServer(t, &Config{
+		EnableAssociate: true,
+		Rules:           denyAssociatePort(denied.Port),
+	})
+	ctrl, relay := associate(t, proxy)
+	defer ctrl.Close()
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+
+	client.Write(udpDatagram(0, denied, "denied"))
+	client.Write(udpDatagram(0, echo, "ping"))
+
+	// Only the allowed destination answers
+	client.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := udpDatagram(0, echo, "ping"); !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
+
+func TestSOCKS5_MaxUDPAssociations(t *testing.T) {
+	ts := startServerWith(t, &Config{EnableAssociate: true, MaxUDPAssociations: 1})
+	ctrl, _ := associate(t, ts.addr)
+	if n := ts.Stats().UDPAssociations; n != 1 {
+		t.Fatalf("bad: %v", n)
+	}
+	if n := ts.Stats().EstimatedMemoryBytes; n != connMemoryEstimate+maxUDPPacketSize {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// A second association is refused
+	other, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(time.Second))
+	other.Write([]byte{5, 1, NoAuth, 5, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(other, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != serverFailure {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// Ending the association frees the slot
+	ctrl.Close()
+	time.Sleep(20 * time.Millisecond)
+	if n := ts.Stats().UDPAssociations; n != 0 {
+		t.Fatalf("bad: %v", n)
+	}
+	ctrl, _ = associate(t, ts.addr)
+	ctrl.Close()
+}